@@ -0,0 +1,65 @@
+package httpmockserver
+
+// CapturedRequest is a request that was received by the mock server
+// it can be used to verify a request after it was made (arrange-act-assert)
+// each assertion fails via T on mismatch, further assertions in the chain are skipped after the first failure
+type CapturedRequest struct {
+	t      T
+	in     *IncomingRequest
+	failed bool
+}
+
+// Request returns the underlying incoming request
+func (c *CapturedRequest) Request() *IncomingRequest {
+	return c.in
+}
+
+// Method asserts that the request used the given method (e.g. GET, POST), the method is compared case-insensitively
+func (c *CapturedRequest) Method(method string) *CapturedRequest {
+	return c.assert(methodValidation(method))
+}
+
+// MethodExact asserts that the request used exactly the given method, the method is compared case-sensitively
+func (c *CapturedRequest) MethodExact(method string) *CapturedRequest {
+	return c.assert(methodExactValidation(method))
+}
+
+// Path asserts that the request was made to the given path (e.g. /foo/bar)
+func (c *CapturedRequest) Path(path string) *CapturedRequest {
+	return c.assert(pathValidation(path))
+}
+
+// HeaderEquals asserts that the request has a header with the given value
+func (c *CapturedRequest) HeaderEquals(name, value string) *CapturedRequest {
+	return c.assert(headerValidation(name, value))
+}
+
+// QueryParameterEquals asserts that the request has a query parameter with the given value
+func (c *CapturedRequest) QueryParameterEquals(name, value string) *CapturedRequest {
+	return c.assert(queryParameterValidation(name, value))
+}
+
+// BodyEquals asserts that the request body equals the given string
+func (c *CapturedRequest) BodyEquals(body string) *CapturedRequest {
+	return c.assert(bodyValidation([]byte(body)))
+}
+
+// JSONPathEquals asserts that the json body contains the given value using jsonPath notation (numbers are compared by value)
+// see: https://github.com/oliveagle/jsonpath
+func (c *CapturedRequest) JSONPathEquals(jsonPath string, value interface{}) *CapturedRequest {
+	return c.assert(jsonPathContainsValidation(jsonPath, value))
+}
+
+func (c *CapturedRequest) assert(validation RequestValidationFunc) *CapturedRequest {
+	c.t.Helper()
+	if c.failed {
+		return c
+	}
+
+	if err := validation(c.in); err != nil {
+		c.failed = true
+		c.t.Fatalf("captured request assertion failed: %v", err)
+	}
+
+	return c
+}
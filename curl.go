@@ -0,0 +1,339 @@
+package httpmockserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExpectationSpec describes a request parsed from a curl command (see FromCurl)
+type ExpectationSpec struct {
+	// Method is the request method given by -X, POST if data is sent, GET otherwise
+	Method string
+	// Path is the path of the request url (default: /)
+	Path string
+	// Query contains the query parameters of the request url
+	Query url.Values
+	// Headers contains the headers given by -H
+	Headers http.Header
+	// Body is the data given by -d, --data-raw, --data-binary or --data-ascii (multiple values are joined with &)
+	// nil if no data is sent
+	Body []byte
+	// Username and Password are the basic auth credentials given by -u (empty if not set)
+	Username string
+	Password string
+}
+
+// ignoredCurlFlags are curl options without an argument that do not change the request
+var ignoredCurlFlags = map[string]bool{
+	"-s": true, "--silent": true,
+	"-S": true, "--show-error": true,
+	"-v": true, "--verbose": true,
+	"-i": true, "--include": true,
+	"-L": true, "--location": true,
+	"-k": true, "--insecure": true,
+}
+
+// FromCurl parses a curl command (e.g. curl -X POST -H 'Content-Type: application/json' -d '{"a":1}' http://localhost/api)
+// the method (-X, --request), url path and query, headers (-H, --header), body (-d, --data, --data-raw, --data-binary, --data-ascii)
+// and basic auth (-u, --user) are supported, options that do not change the request (e.g. -s, -v, -L, -k) are ignored
+// any other option results in an error listing all unsupported options
+// arguments may be quoted using single quotes, double quotes or $'...' strings like in a posix shell
+func FromCurl(cmd string) (ExpectationSpec, error) {
+	args, err := splitShellWords(cmd)
+	if err != nil {
+		return ExpectationSpec{}, fmt.Errorf("could not parse curl command: %v", err)
+	}
+	if len(args) > 0 && args[0] == "curl" {
+		args = args[1:]
+	}
+
+	spec := ExpectationSpec{Headers: http.Header{}}
+	var urls []string
+	var data []string
+	var unsupported []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// value returns the argument of the current option, either attached (e.g. -XPOST) or the next word
+		value := func(attached string) (string, bool) {
+			if attached != "" {
+				return attached, true
+			}
+			if i+1 >= len(args) {
+				return "", false
+			}
+			i++
+			return args[i], true
+		}
+
+		name, attached := arg, ""
+		if len(arg) > 2 && arg[0] == '-' && arg[1] != '-' {
+			name, attached = arg[:2], arg[2:]
+		}
+
+		switch {
+		case name == "-X" || name == "--request":
+			method, ok := value(attached)
+			if !ok {
+				return ExpectationSpec{}, fmt.Errorf("curl option %v requires a method", arg)
+			}
+			spec.Method = strings.ToUpper(method)
+		case name == "-H" || name == "--header":
+			header, ok := value(attached)
+			if !ok {
+				return ExpectationSpec{}, fmt.Errorf("curl option %v requires a header", arg)
+			}
+			key, val, found := strings.Cut(header, ":")
+			if !found {
+				return ExpectationSpec{}, fmt.Errorf("invalid curl header %q: expected name: value", header)
+			}
+			// curl removes a header given without value, so it is not expected either
+			if val = strings.TrimSpace(val); val != "" {
+				spec.Headers.Add(strings.TrimSpace(key), val)
+			}
+		case name == "-d" || name == "--data" || name == "--data-raw" || name == "--data-binary" || name == "--data-ascii":
+			d, ok := value(attached)
+			if !ok {
+				return ExpectationSpec{}, fmt.Errorf("curl option %v requires data", arg)
+			}
+			if name != "--data-raw" && strings.HasPrefix(d, "@") {
+				unsupported = append(unsupported, arg+" @file")
+				continue
+			}
+			data = append(data, d)
+		case name == "-u" || name == "--user":
+			user, ok := value(attached)
+			if !ok {
+				return ExpectationSpec{}, fmt.Errorf("curl option %v requires user:password", arg)
+			}
+			username, password, found := strings.Cut(user, ":")
+			if !found {
+				return ExpectationSpec{}, fmt.Errorf("curl option %v requires user:password, prompting for a password is not supported", arg)
+			}
+			spec.Username, spec.Password = username, password
+		case name == "--url":
+			u, ok := value(attached)
+			if !ok {
+				return ExpectationSpec{}, fmt.Errorf("curl option %v requires an url", arg)
+			}
+			urls = append(urls, u)
+		case ignoredCurlFlags[arg] || ignoredShortFlags(arg):
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			unsupported = append(unsupported, arg)
+		default:
+			urls = append(urls, arg)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return ExpectationSpec{}, fmt.Errorf("unsupported curl option(s): %v", strings.Join(unsupported, ", "))
+	}
+	if len(urls) != 1 {
+		return ExpectationSpec{}, fmt.Errorf("curl command must contain exactly one url but contains %d: %v", len(urls), strings.Join(urls, ", "))
+	}
+
+	rawURL := urls[0]
+	// curl assumes http if the url has no scheme
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ExpectationSpec{}, fmt.Errorf("invalid curl url %v: %v", rawURL, err)
+	}
+	spec.Path = u.Path
+	if spec.Path == "" {
+		spec.Path = "/"
+	}
+	spec.Query = u.Query()
+
+	if data != nil {
+		spec.Body = []byte(strings.Join(data, "&"))
+	}
+	if spec.Method == "" {
+		spec.Method = http.MethodGet
+		if spec.Body != nil {
+			spec.Method = http.MethodPost
+		}
+	}
+
+	return spec, nil
+}
+
+// apply adds a validation for each field of the spec to the expectation
+// query parameters with an empty value are ignored like in LikeRequest
+func (spec ExpectationSpec) apply(exp *requestExpectation) {
+	exp.Method(spec.Method)
+	exp.appendValidation(pathValidation(spec.Path), "Path: "+spec.Path)
+
+	for _, key := range sortedKeys(spec.Query) {
+		if value := spec.Query.Get(key); value != "" {
+			exp.QueryParameter(key, value)
+		}
+	}
+	for _, name := range sortedKeys(spec.Headers) {
+		exp.Header(name, spec.Headers.Get(name))
+	}
+	if spec.Username != "" {
+		exp.BasicAuth(spec.Username, spec.Password)
+	}
+	if spec.Body != nil {
+		exp.Body(spec.Body)
+	}
+}
+
+// ignoredShortFlags checks if arg combines short options that do not change the request (e.g. -sSL)
+func ignoredShortFlags(arg string) bool {
+	if len(arg) < 2 || arg[0] != '-' || arg[1] == '-' {
+		return false
+	}
+	for _, c := range arg[1:] {
+		if !ignoredCurlFlags["-"+string(c)] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitShellWords splits a command line into words like a posix shell
+// single quotes, double quotes, $'...' strings, backslash escapes and line continuations are supported
+func splitShellWords(cmd string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 >= len(cmd) {
+				return nil, fmt.Errorf("unexpected end of command after backslash")
+			}
+			i++
+			// a backslash before a newline continues the line
+			if cmd[i] == '\n' {
+				continue
+			}
+			word.WriteByte(cmd[i])
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				// inside double quotes a backslash only escapes $, `, ", \ and newline
+				if cmd[i] == '\\' && i+1 < len(cmd) && strings.IndexByte("$`\"\\\n", cmd[i+1]) >= 0 {
+					i++
+					if cmd[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(cmd[i])
+			}
+			if i >= len(cmd) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inWord = true
+		case c == '$' && i+1 < len(cmd) && cmd[i+1] == '\'':
+			n, err := readANSICString(cmd[i+2:], &word)
+			if err != nil {
+				return nil, err
+			}
+			i += n + 2
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// readANSICString decodes the content of a $'...' string up to the closing quote into word
+// it returns the number of bytes consumed including the closing quote
+func readANSICString(s string, word *strings.Builder) (int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\'' {
+			return i + 1, nil
+		}
+		if c != '\\' {
+			word.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			break
+		}
+		switch s[i] {
+		case 'n':
+			word.WriteByte('\n')
+		case 't':
+			word.WriteByte('\t')
+		case 'r':
+			word.WriteByte('\r')
+		case 'a':
+			word.WriteByte('\a')
+		case 'b':
+			word.WriteByte('\b')
+		case 'e', 'E':
+			word.WriteByte(0x1b)
+		case 'f':
+			word.WriteByte('\f')
+		case 'v':
+			word.WriteByte('\v')
+		case 'x':
+			end := i + 1
+			for end < len(s) && end < i+3 && isHexDigit(s[end]) {
+				end++
+			}
+			if end == i+1 {
+				return 0, fmt.Errorf("invalid hex escape in $'...' string")
+			}
+			b, _ := strconv.ParseUint(s[i+1:end], 16, 8)
+			word.WriteByte(byte(b))
+			i = end - 1
+		case '\\', '\'', '"', '?':
+			word.WriteByte(s[i])
+		default:
+			// unknown escapes are kept as is
+			word.WriteByte('\\')
+			word.WriteByte(s[i])
+		}
+	}
+	return 0, fmt.Errorf("unterminated $'...' string")
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
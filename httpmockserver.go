@@ -3,14 +3,20 @@ package httpmockserver
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Opts is used to configure the mock server
@@ -24,15 +30,73 @@ type Opts struct {
 	Cert io.Reader
 	// Key is the key used for SSL
 	Key io.Reader
+	// TLSConfig is the base of the tls configuration if UseSSL is set, e.g. to set MinVersion, CipherSuites or ClientAuth
+	// Cert and Key are added to its certificates, they may be omitted if it already provides a certificate
+	// (default: NextProtos "http/1.1" and "h2", set NextProtos to []string{"http/1.1"} to disable http/2)
+	TLSConfig *tls.Config
+	// DefaultResponseHeaders are set on every response, headers of the response expectation override them
+	DefaultResponseHeaders map[string]string
+	// ResponseDelay delays every response by the given duration (e.g. for timeout testing)
+	// it is added to the delay of the response expectation (see ResponseExpectation.Delay)
+	ResponseDelay time.Duration
+	// Clock returns the current time used by time based validations, e.g. JWTTokenNotExpired (default: time.Now)
+	Clock func() time.Time
+	// MatchExhaustedExpectations keeps matching expectations that already reached their maximum number of calls
+	// (default: false, exhausted expectations are skipped, so the request is matched by the next expectation or a default)
+	MatchExhaustedExpectations bool
+	// StrictMatching makes all EXPECT expectations strict (see RequestExpectation.Strict), DEFAULT and EVERY expectations
+	// are only strict if Strict is called on them (default: false)
+	StrictMatching bool
+	// VerboseMismatch prints complete request bodies in failure messages (default: false)
+	// otherwise bodies longer than 256 bytes are truncated or reported by a diff
+	VerboseMismatch bool
+	// MaxBodyBytes limits the size of request bodies (default: 0, unlimited)
+	// larger requests are answered with 413 Request Entity Too Large without matching expectations
+	// and are recorded with IncomingRequest.BodyTruncated set
+	MaxBodyBytes int64
+	// LazyBody only reads the request body if an expectation needs it, e.g. for body, form or multipart validations,
+	// templates or response funcs (default: false, the body is always read)
+	// otherwise IncomingRequest.Body is empty and the body can be streamed once by IncomingRequest.BodyReader
+	// BodyStreamFunc validations then run after the request was matched by the other validations (see BodyStreamFunc)
+	// and MaxBodyBytes is checked against the Content-Length and while the body is streamed
+	LazyBody bool
+	// PrettyJSON indents the bodies set by ResponseExpectation.JsonBody with two spaces (default: false, compact json)
+	// already encoded json is written verbatim
+	PrettyJSON bool
+	// SniffContentType sets the content type of bodies set by ResponseExpectation.Body with http.DetectContentType
+	// if it is not set yet (default: false, net/http sniffs the content type when writing the response)
+	SniffContentType bool
+	// DetectAmbiguous reports unsatisfied expectations that are shadowed by an expectation with the same (or fewer)
+	// validations that is checked first and therefore matches their requests (default: false)
+	DetectAmbiguous bool
+	// StrictResponseSequences fails calls beyond a response sequence (see ResponseExpectation.Then)
+	// (default: false, the last response of the sequence is repeated)
+	StrictResponseSequences bool
+	// IgnoredHeaders are accepted by Strict and HeadersExactly without being expected, in addition to the headers
+	// set by http clients automatically (Host, Content-Length, Content-Type, User-Agent, Accept-Encoding) and hop-by-hop headers
+	IgnoredHeaders []string
+	// Rand is the random source of random response delays, e.g. ResponseExpectation.DelayBetween
+	// set it to a seeded source (rand.New(rand.NewSource(42))) to reproduce the delays of a test run (default: seeded with the current time)
+	Rand *rand.Rand
+	// DebugLog receives a trace of each request: the expectations that were tried, the first validation that failed
+	// for each of them and the expectation that finally matched (default: nil, no trace), e.g. os.Stderr
+	DebugLog io.Writer
 }
 
 func (o *Opts) validate() error {
-	if o.UseSSL && (o.Cert == nil || o.Key == nil) {
+	hasCertificate := o.TLSConfig != nil && (len(o.TLSConfig.Certificates) > 0 || o.TLSConfig.GetCertificate != nil)
+	if o.UseSSL && (o.Cert == nil || o.Key == nil) && !hasCertificate {
 		return fmt.Errorf("UseSSL is set to true but no certificate or key is provided")
 	}
 	if o.Port == "" {
 		o.Port = "0"
 	}
+	if o.Clock == nil {
+		o.Clock = time.Now
+	}
+	if o.Rand == nil {
+		o.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 	// check if port can be parsed to an integer atoi
 	i, err := strconv.Atoi(o.Port)
 	if err != nil {
@@ -47,6 +111,13 @@ func (o *Opts) validate() error {
 type MockServer interface {
 	// BaseURL returns the base url of the mock server (default: http://127.0.0.1:<random_port>)
 	BaseURL() string
+	// URL returns the absolute url for the given path (slashes between base url and path are handled)
+	// optional query values are encoded and appended to the url
+	URL(path string, query ...url.Values) string
+	// Transport returns a http.RoundTripper that passes requests directly to the mock server without network I/O
+	// (e.g. &http.Client{Transport: server.Transport()}), all validations and call counts apply like for requests to BaseURL
+	// the scheme and host of the request url are ignored
+	Transport() http.RoundTripper
 	// ServeHTTP provides direct access to the http handler, normally this is not required
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 	// EVERY returns a RequestExpectation that will match on any call
@@ -56,13 +127,54 @@ type MockServer interface {
 	// the default number of calls is expected to be exactly one
 	// this can be changed by calling a method like: Times, MinTimes, MaxTimes, etc.
 	EXPECT() RequestExpectation
+	// NthRequest returns a RequestExpectation that only matches the n-th request received by the mock server (starting at 1)
+	// regardless of its path, e.g. NthRequest(3).Get("/health") to assert the order of calls in an integration flow
+	// it is expected exactly once, so AssertExpectations fails if the n-th request did not satisfy its validations
+	NthRequest(n int) RequestExpectation
 	// DEFAULT returns a RequestExpectation that will be executed if no other expectation matches
 	DEFAULT() RequestExpectation
+	// Disable skips the given expectation while matching requests until Enable is called
+	// a disabled expectation is still checked by AssertExpectations (e.g. against its minimum number of calls)
+	Disable(exp Expectation)
+	// Enable matches requests against an expectation disabled by Disable again
+	Enable(exp Expectation)
+	// Remove removes the given expectation (EXPECT, DEFAULT or EVERY), it is neither matched nor checked anymore
+	Remove(exp Expectation)
+	// Route returns a Route whose expectations use paths relative to the given prefix (e.g. /api/v2)
+	Route(prefix string) Route
+	// InOrder returns an OrderedGroup whose expectations must be matched in the order they were declared
+	// expectations outside the group remain order-independent
+	InOrder() OrderedGroup
 	// AssertExpectations should be called to check if all expectations have been met
 	// It also removes all expectations (except the default and every expectations).
 	// This let you reuse the same mock server for multiple tests.
 	AssertExpectations()
+	// Scoped returns a view on the mock server whose expectations are isolated from other scopes
+	// the scope shares the underlying http server, but its expectations are reported to the given T
+	// and AssertExpectations on the scope only checks (and removes) expectations registered on the scope.
+	// Requests, LastRequest, WaitForRequests and LastResponse of the scope only report requests matched by its expectations.
+	// This allows sharing one mock server across parallel subtests (t.Parallel()).
+	Scoped(t T) MockServer
+	// Requests returns all requests received by the mock server so far (in order of arrival)
+	Requests() []*CapturedRequest
+	// LastRequest returns the last request received by the mock server or nil if no request was received
+	LastRequest() *CapturedRequest
+	// LastResponse returns the response written for the most recent request or nil if no response was written yet
+	LastResponse() *MockResponse
+	// OnRequest registers a hook that is called for each incoming request before it is matched (e.g. for logging or metrics)
+	// multiple hooks are called in registration order, they observe the request and cannot affect the matching
+	// hooks registered on a scope are called for the requests of all scopes of the mock server
+	OnRequest(hook func(in *IncomingRequest))
+	// OnResponse registers a hook that is called after each response of an expectation or default was written
+	// (e.g. to log what the mock returned after templates and sequences were resolved), in registration order
+	// the hook receives a copy of the response, a panic of the hook fails the test (t.Errorf with the request details)
+	// hooks registered on a scope are called for the responses of all scopes of the mock server
+	OnResponse(hook ResponseHook)
+	// WaitForRequests blocks until the mock server received at least n requests (matched or not) or the timeout elapses
+	// on timeout an error containing the number of received requests is returned
+	WaitForRequests(n int, timeout time.Duration) error
 	// Shutdown should be called to stop the mock server (should be deferred at the beginning of the test function)
+	// calling it again has no effect
 	Shutdown()
 }
 
@@ -109,7 +221,34 @@ func NewWithOpts(t T, opts Opts) MockServer {
 	}
 
 	mockServerInst := &mockServer{
-		t: t,
+		t:     t,
+		done:  make(chan struct{}),
+		clock: opts.Clock,
+
+		requestReceived: make(chan struct{}),
+
+		defaultResponseHeaders:     opts.DefaultResponseHeaders,
+		responseDelay:              opts.ResponseDelay,
+		matchExhaustedExpectations: opts.MatchExhaustedExpectations,
+		strictMatching:             opts.StrictMatching,
+		verboseMismatch:            opts.VerboseMismatch,
+		maxBodyBytes:               opts.MaxBodyBytes,
+		lazyBody:                   opts.LazyBody,
+		prettyJSON:                 opts.PrettyJSON,
+		sniffContentType:           opts.SniffContentType,
+		detectAmbiguous:            opts.DetectAmbiguous,
+		strictResponseSequences:    opts.StrictResponseSequences,
+		rand:                       opts.Rand,
+		debugLog:                   opts.DebugLog,
+		ignoredHeaders:             make(map[string]bool, len(opts.IgnoredHeaders)),
+	}
+	for _, name := range opts.IgnoredHeaders {
+		mockServerInst.ignoredHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range opts.DefaultResponseHeaders {
+		if http.CanonicalHeaderKey(name) == "Content-Type" {
+			mockServerInst.defaultContentType = true
+		}
 	}
 
 	// if port is not set to random (0) close the listener and change the port
@@ -126,6 +265,15 @@ func NewWithOpts(t T, opts Opts) MockServer {
 	}
 
 	if opts.UseSSL {
+		mockServerInst.server.TLS = &tls.Config{}
+		if opts.TLSConfig != nil {
+			// the config is cloned, so the config of the caller is not modified
+			mockServerInst.server.TLS = opts.TLSConfig.Clone()
+		}
+		if mockServerInst.server.TLS.NextProtos == nil {
+			mockServerInst.server.TLS.NextProtos = []string{"http/1.1", "h2"}
+		}
+
 		if opts.Cert != nil && opts.Key != nil {
 			key, _ := io.ReadAll(opts.Key)
 			cert, _ := io.ReadAll(opts.Cert)
@@ -135,9 +283,7 @@ func NewWithOpts(t T, opts Opts) MockServer {
 				t.Fatal("could not load certificate: ", err.Error())
 			}
 
-			mockServerInst.server.TLS = &tls.Config{}
-			mockServerInst.server.TLS.NextProtos = []string{"http/1.1", "h2"}
-			mockServerInst.server.TLS.Certificates = []tls.Certificate{xCert}
+			mockServerInst.server.TLS.Certificates = append(mockServerInst.server.TLS.Certificates, xCert)
 		}
 
 		mockServerInst.server.StartTLS()
@@ -155,184 +301,1558 @@ type mockServer struct {
 	t T
 
 	handlerMutex sync.Mutex
+	// done is closed on Shutdown to release stalled responses
+	done chan struct{}
+	// shutdownOnce makes repeated calls of Shutdown a no-op
+	shutdownOnce sync.Once
+	// clock returns the current time for time based validations
+	clock func() time.Time
+
+	defaultResponseHeaders     map[string]string
+	responseDelay              time.Duration
+	matchExhaustedExpectations bool
+	strictMatching             bool
+	verboseMismatch            bool
+	maxBodyBytes               int64
+	lazyBody                   bool
+	prettyJSON                 bool
+	sniffContentType           bool
+	defaultContentType         bool
+	detectAmbiguous            bool
+	strictResponseSequences    bool
+	ignoredHeaders             map[string]bool
+	// rand is the random source of response delays, it is guarded by the handler lock
+	rand *rand.Rand
+	// debugLog receives the match trace of each request (see Opts.DebugLog)
+	debugLog io.Writer
+
+	// requestHooks are called for each incoming request before matching (see OnRequest)
+	requestHooks []func(in *IncomingRequest)
+	// responseHooks are called after each response of an expectation or default was written (see OnResponse)
+	responseHooks []ResponseHook
 
 	every        []*requestExpectation
 	expectations []*requestExpectation
 	defaults     []*requestExpectation
+
+	requests []*IncomingRequest
+	// requestReceived is closed and replaced whenever a request is received
+	requestReceived chan struct{}
+	// lastResponse is the response written for the most recent request
+	lastResponse *MockResponse
 }
 
 func (s *mockServer) BaseURL() string {
 	return s.server.URL
 }
 
+func (s *mockServer) URL(path string, query ...url.Values) string {
+	u := strings.TrimSuffix(s.BaseURL(), "/")
+	if path != "" {
+		u += "/" + strings.TrimPrefix(path, "/")
+	}
+
+	values := url.Values{}
+	for _, q := range query {
+		for key, vals := range q {
+			values[key] = append(values[key], vals...)
+		}
+	}
+	if len(values) == 0 {
+		return u
+	}
+
+	if strings.Contains(u, "?") {
+		return u + "&" + values.Encode()
+	}
+	return u + "?" + values.Encode()
+}
+
+func (s *mockServer) Transport() http.RoundTripper {
+	return &transport{server: s}
+}
+
 func (s *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.t.Helper()
-	s.handlerMutex.Lock()
-	defer s.handlerMutex.Unlock()
+	receivedAt := s.clock()
 
-	err := r.ParseForm()
-	if err != nil {
-		s.t.Fatal("could not parse form parameters of http request")
+	if s.maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
+
+	if s.lazyBody && !s.bodyNeeded() {
+		// the body is left unread, it can be streamed by IncomingRequest.BodyReader
+		in := &IncomingRequest{
+			R:              r,
+			Query:          r.URL.Query(),
+			Form:           r.URL.Query(),
+			PostForm:       url.Values{},
+			ReceivedAt:     receivedAt,
+			unreadBody:     &unreadBody{Reader: r.Body},
+			clock:          s.clock,
+			verbose:        s.verboseMismatch,
+			ignoredHeaders: s.ignoredHeaders,
+		}
+		if s.maxBodyBytes > 0 && r.ContentLength > s.maxBodyBytes {
+			s.rejectOversized(w, in, s.maxBodyBytes)
+			return
+		}
+
+		matched := s.matchResponse(in)
+		if matched == nil {
+			return
+		}
+		resp := s.prepareResponse(matched, in)
+		if resp == nil {
+			return
+		}
+
+		resp.echo(in)
+		s.writeResponse(w, r, resp)
+		s.runResponseHooks(in, resp)
+		return
 	}
 
+	// reading the request is done before acquiring the handler lock, so slow clients do not block other requests
 	body, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		s.rejectOversized(w, &IncomingRequest{
+			R:              r,
+			Body:           body,
+			Query:          r.URL.Query(),
+			ReceivedAt:     receivedAt,
+			clock:          s.clock,
+			verbose:        s.verboseMismatch,
+			ignoredHeaders: s.ignoredHeaders,
+		}, maxBytesErr.Limit)
+		return
+	}
 	if err != nil {
 		s.t.Fatal("request validation failed: could not read incoming request body: ", err.Error())
 	}
 
-	incomingRequest := &IncomingRequest{
-		R:    r,
-		Body: body,
+	// the body is restored, so parsing the form parameters does not consume it
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	// a malformed form body only fails form validations, so requests matched by their raw body are not affected
+	formErr := r.ParseForm()
+	if r.Form == nil {
+		r.Form = r.URL.Query()
+	}
+	if r.PostForm == nil {
+		r.PostForm = url.Values{}
+	}
+
+	in := &IncomingRequest{
+		R:              r,
+		Body:           body,
+		Query:          r.URL.Query(),
+		Form:           r.Form,
+		PostForm:       r.PostForm,
+		ReceivedAt:     receivedAt,
+		formErr:        formErr,
+		clock:          s.clock,
+		verbose:        s.verboseMismatch,
+		ignoredHeaders: s.ignoredHeaders,
+	}
+	matched := s.matchResponse(in)
+	if matched == nil {
+		return
+	}
+	resp := s.prepareResponse(matched, in)
+	if resp == nil {
+		return
+	}
+
+	// the echoed headers are generated without holding the handler lock, so a generator may use the mock server
+	resp.echo(in)
+	s.writeResponse(w, r, resp)
+	s.runResponseHooks(in, resp)
+}
+
+// rejectOversized answers a request whose body exceeds Opts.MaxBodyBytes with 413 Request Entity Too Large
+// the oversized request is recorded with the part of the body read so far, but not matched
+func (s *mockServer) rejectOversized(w http.ResponseWriter, in *IncomingRequest, limit int64) {
+	in.BodyTruncated = true
+	s.runRequestHooks(in)
+
+	s.handlerMutex.Lock()
+	s.recordRequest(in)
+	s.handlerMutex.Unlock()
+
+	http.Error(w, fmt.Sprintf("request body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// unreadBody is the request body left unread by Opts.LazyBody, it remembers if reading it exceeded Opts.MaxBodyBytes
+type unreadBody struct {
+	io.Reader
+	exceeded *http.MaxBytesError
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded = maxBytesErr
+	}
+	return n, err
+}
+
+// runRequestHooks calls the hooks registered by OnRequest in order
+// they are called without holding the handler lock, so a hook may use the mock server (e.g. Requests)
+func (s *mockServer) runRequestHooks(in *IncomingRequest) {
+	s.handlerMutex.Lock()
+	hooks := s.requestHooks
+	s.handlerMutex.Unlock()
+
+	for _, hook := range hooks {
+		s.callRequestHook(hook, in)
+	}
+}
+
+// callRequestHook calls the hook, a panic of the hook fails the test and the request is matched as usual
+func (s *mockServer) callRequestHook(hook func(in *IncomingRequest), in *IncomingRequest) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.t.Errorf("OnRequest hook panicked: %v\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v", recovered, in.R.Method, in.R.URL.Path, in.R.Header, bodyString(in))
+		}
+	}()
+
+	hook(in)
+}
+
+func (s *mockServer) OnRequest(hook func(in *IncomingRequest)) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	// the hooks are copied on write, so running hooks are not affected by hooks registered concurrently
+	s.requestHooks = append(append([]func(in *IncomingRequest){}, s.requestHooks...), hook)
+}
+
+func (s *mockServer) OnResponse(hook ResponseHook) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	// the hooks are copied on write, so running hooks are not affected by hooks registered concurrently
+	s.responseHooks = append(append([]ResponseHook{}, s.responseHooks...), hook)
+}
+
+// ResponseHook is called after a response was written (see MockServer.OnResponse and ResponseExpectation.OnResponse)
+type ResponseHook func(in *IncomingRequest, resp *MockResponse, source ResponseSource)
+
+// ResponseSource describes the expectation that produced a response
+type ResponseSource struct {
+	// Kind is EXPECT or DEFAULT
+	Kind string
+	// Number is the number of the expectation in registration order (starting at 1, as reported by AssertExpectations)
+	Number int
+	// Description lists the validations of the expectation (e.g. Method: GET AND Path: /users)
+	Description string
+	// Call is the number of the matching call of the expectation (starting at 1)
+	Call int
+}
+
+// servedResponse describes the expectation that produced a response and the hooks to call after it was written
+type servedResponse struct {
+	source           ResponseSource
+	t                T
+	expectationHooks []ResponseHook
+	serverHooks      []ResponseHook
+}
+
+// served describes the matched expectation of a response for the OnResponse hooks, nil if there are no hooks
+// it is called while holding the handler lock
+func (s *mockServer) served(exp *requestExpectation, call int) *servedResponse {
+	if len(exp.responseHooks) == 0 && len(s.responseHooks) == 0 {
+		return nil
+	}
+
+	source := ResponseSource{Kind: "EXPECT", Description: traceDescription(exp), Call: call}
+	if exp.defaultExp {
+		source.Kind = "DEFAULT"
+		source.Number = expectationNumber(exp, s.defaults, exp.owner)
+	} else {
+		source.Number = expectationNumber(exp, s.expectations, exp.owner)
+	}
+	return &servedResponse{source: source, t: exp.t, expectationHooks: exp.responseHooks, serverHooks: s.responseHooks}
+}
+
+// runResponseHooks calls the hooks registered by OnResponse after the response was written
+// the hooks of the expectation are called first, each hook receives its own copy of the response,
+// so it cannot modify the response of later calls or the response seen by other hooks
+func (s *mockServer) runResponseHooks(in *IncomingRequest, resp *MockResponse) {
+	served := resp.served
+	if served == nil {
+		return
+	}
+
+	for _, hook := range served.expectationHooks {
+		callResponseHook(served.t, hook, in, resp, served.source)
+	}
+	for _, hook := range served.serverHooks {
+		callResponseHook(s.t, hook, in, resp, served.source)
+	}
+}
+
+// callResponseHook calls the hook with a copy of the response, a panic of the hook fails the test
+func callResponseHook(t T, hook ResponseHook, in *IncomingRequest, resp *MockResponse, source ResponseSource) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			t.Errorf("OnResponse hook panicked: %v\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v", recovered, in.R.Method, in.R.URL.Path, in.R.Header, bodyString(in))
+		}
+	}()
+
+	observed := resp.copy()
+	observed.Body = append([]byte(nil), resp.Body...)
+	observed.Raw = append([]byte(nil), resp.Raw...)
+	if resp.Chunks != nil {
+		observed.Chunks = make([][]byte, 0, len(resp.Chunks))
+		for _, chunk := range resp.Chunks {
+			observed.Chunks = append(observed.Chunks, append([]byte(nil), chunk...))
+		}
+	}
+	observed.served = nil
+	hook(in, observed, source)
+}
+
+// bodyNeeded checks if any expectation needs the buffered request body (see Opts.LazyBody)
+func (s *mockServer) bodyNeeded() bool {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	for _, list := range [][]*requestExpectation{s.every, s.expectations, s.defaults} {
+		for _, exp := range list {
+			if exp.needsBody() {
+				return true
+			}
+		}
 	}
+	return false
+}
+
+// recordRequest adds the request to the request log and wakes up WaitForRequests
+// the handler lock must be held by the caller
+func (s *mockServer) recordRequest(in *IncomingRequest) {
+	s.requests = append(s.requests, in)
+	in.number = len(s.requests)
+	close(s.requestReceived)
+	s.requestReceived = make(chan struct{})
+}
+
+// matchResponse validates the incoming request against all expectations and returns the matched expectation
+// nil is returned if no expectation matched
+// the handler lock is only held while matching, the response is prepared and written by the caller
+func (s *mockServer) matchResponse(incomingRequest *IncomingRequest) *matchedResponse {
+	s.t.Helper()
+	s.runRequestHooks(incomingRequest)
+
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	r := incomingRequest.R
+	s.recordRequest(incomingRequest)
+
+	// the trace is written while holding the handler lock, so traces of concurrent requests are not mixed
+	trace := s.newMatchTrace(incomingRequest)
+	defer trace.flush()
 
+	// streamValidations read the unread body after matching (see Opts.LazyBody)
+	var streamValidations []streamValidation
 	// check EVERY expectation
 	for _, every := range s.every {
+		if every.disabled {
+			continue
+		}
+		failed := false
 		for _, everyExp := range every.requestValidations {
+			if everyExp.deferred(incomingRequest) {
+				streamValidations = append(streamValidations, streamValidation{t: every.t, val: everyExp})
+				continue
+			}
 			if err := everyExp.validation(incomingRequest); err != nil {
-				s.t.Errorf("expectation failed: %v", err)
+				every.t.Errorf("expectation failed: %v", err)
+				if !failed {
+					trace.attempt("EVERY", every, s.every, validationFailure(everyExp, err))
+				}
+				failed = true
+			}
+		}
+		if err := s.strictValidation(every, incomingRequest); err != nil {
+			every.t.Errorf("expectation failed: %v", err)
+			if !failed {
+				trace.attempt("EVERY", every, s.every, "not matched: %v", strings.TrimPrefix(err.Error(), "request validation failed: "))
 			}
+			failed = true
+		}
+		if !failed {
+			trace.attempt("EVERY", every, s.every, "passed")
 		}
 	}
 
 	var matchedExpectation *requestExpectation
+	// outOfOrder is an expectation of an ordered group that matched before its predecessors were satisfied
+	var outOfOrder, pending *requestExpectation
+	// exhausted is the first matching expectation that already reached its maximum number of calls
+	// it is only used if neither another expectation nor a default matches, so the excess call is reported
+	var exhausted *requestExpectation
+	// closest is the expectation that matched the most validations before one failed, it is reported for unexpected calls
+	var closest closestMatch
 	// check if call matches an expectation
 outerExp:
-	for _, exp := range s.expectations {
-		for _, reqVal := range exp.requestValidations {
+	for _, exp := range byPriority(s.expectations) {
+		if exp.disabled {
+			trace.attempt("EXPECT", exp, s.expectations, "disabled")
+			continue
+		}
+		incomingRequest.PathParams = nil
+		incomingRequest.BodyMatches = nil
+		for i, reqVal := range exp.requestValidations {
+			if reqVal.deferred(incomingRequest) {
+				continue
+			}
 			if err := reqVal.validation(incomingRequest); err != nil {
+				trace.attempt("EXPECT", exp, s.expectations, validationFailure(reqVal, err))
+				closest.update(exp, i, reqVal.description, err)
 				continue outerExp
 			}
 			reqVal.satisfied = true
 		}
 
+		if err := s.strictValidation(exp, incomingRequest); err != nil {
+			exp.strictViolation = strings.TrimPrefix(err.Error(), "request validation failed: ")
+			trace.attempt("EXPECT", exp, s.expectations, "not matched: %v", exp.strictViolation)
+			closest.update(exp, len(exp.requestValidations), "Strict", err)
+			continue
+		}
+
+		if exp.group != nil {
+			if unsatisfied := exp.group.unsatisfiedBefore(exp); unsatisfied != nil {
+				if outOfOrder == nil {
+					outOfOrder, pending = exp, unsatisfied
+				}
+				trace.attempt("EXPECT", exp, s.expectations, "skipped: expectation %d of its ordered group is not satisfied yet", exp.group.position(unsatisfied))
+				continue
+			}
+		}
+
+		if !exp.prerequisitesSatisfied() {
+			trace.attempt("EXPECT", exp, s.expectations, "skipped: prerequisites are not satisfied yet")
+			continue
+		}
+
+		// an expectation that must not be called (Never or Times(0)) only records the call,
+		// the response is produced by other expectations or defaults
+		if exp.never || (exp.max == 0 && !s.matchExhaustedExpectations) {
+			exp.recordCall(incomingRequest)
+			exp.t.Errorf("expected never, but was called: %v %v", r.Method, r.URL.Path)
+			trace.attempt("EXPECT", exp, s.expectations, "matched, but must never be called")
+			continue
+		}
+
+		if !s.matchExhaustedExpectations && exp.count >= exp.max {
+			if exhausted == nil {
+				exhausted = exp
+			}
+			trace.attempt("EXPECT", exp, s.expectations, "matched, but exhausted (%d of %d calls)", exp.count, exp.max)
+			continue
+		}
+
 		matchedExpectation = exp
-		matchedExpectation.count++
+		matchedExpectation.recordCall(incomingRequest)
+		trace.attempt("EXPECT", exp, s.expectations, "matched (call %d)", exp.count)
 		break
 	}
 
+	if matchedExpectation == nil && outOfOrder != nil {
+		outOfOrder.group.violations = append(outOfOrder.group.violations, fmt.Sprintf(
+			"%v %v matched expectation %d of ordered group before expectation %d was satisfied",
+			r.Method, r.URL.Path, outOfOrder.group.position(outOfOrder), outOfOrder.group.position(pending),
+		))
+	}
+
+	// partialDefaults describes the defaults that matched some of their validations (e.g. method and path) but not all
+	var partialDefaults bytes.Buffer
 	// if not matched any of the expectations
 	if matchedExpectation == nil {
-		// check if call matches a default
+		// check if call matches a default, a default has to match all of its validations (including body validations)
+		// otherwise the request falls through to the next default
 	outerDefaults:
-		for _, exp := range s.defaults {
-			for _, reqVal := range exp.requestValidations {
+		for _, exp := range byPriority(s.defaults) {
+			if exp.disabled {
+				trace.attempt("DEFAULT", exp, s.defaults, "disabled")
+				continue
+			}
+			incomingRequest.PathParams = nil
+			incomingRequest.BodyMatches = nil
+			for i, reqVal := range exp.requestValidations {
+				if reqVal.deferred(incomingRequest) {
+					continue
+				}
 				if err := reqVal.validation(incomingRequest); err != nil {
+					if i > 0 {
+						partialDefaults.WriteString(fmt.Sprintf("----- %v: %v\n", defaultDescription(exp, i), strings.TrimPrefix(err.Error(), "request validation failed: ")))
+					}
+					trace.attempt("DEFAULT", exp, s.defaults, validationFailure(reqVal, err))
 					continue outerDefaults
 				}
 			}
 
+			if err := s.strictValidation(exp, incomingRequest); err != nil {
+				partialDefaults.WriteString(fmt.Sprintf("----- %v: %v\n", defaultDescription(exp, len(exp.requestValidations)), strings.TrimPrefix(err.Error(), "request validation failed: ")))
+				trace.attempt("DEFAULT", exp, s.defaults, "not matched: %v", strings.TrimPrefix(err.Error(), "request validation failed: "))
+				continue
+			}
+
 			matchedExpectation = exp
+			matchedExpectation.recordCall(incomingRequest)
+			trace.attempt("DEFAULT", exp, s.defaults, "matched (call %d)", exp.count)
 			break
 		}
 	}
 
+	if matchedExpectation == nil && exhausted != nil {
+		// validate again to restore the request state (e.g. path parameters) of the exhausted expectation
+		incomingRequest.PathParams = nil
+		incomingRequest.BodyMatches = nil
+		for _, reqVal := range exhausted.requestValidations {
+			if !reqVal.deferred(incomingRequest) {
+				_ = reqVal.validation(incomingRequest)
+			}
+		}
+
+		matchedExpectation = exhausted
+		matchedExpectation.recordCall(incomingRequest)
+		trace.attempt("EXPECT", exhausted, s.expectations, "matched as the exhausted expectation, no other expectation or default matched (call %d)", exhausted.count)
+	}
+
 	// if no default found log request and return default code
 	if matchedExpectation == nil {
-		s.t.Fatalf("Unexpected call:\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v", r.Method, r.URL.Path, r.Header, string(body))
-		return
+		trace.printf("no expectation or default matched")
+		if partialDefaults.Len() > 0 {
+			s.t.Fatalf("Unexpected call:\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v%v\nDefaults not matched:\n%v", r.Method, r.URL.Path, r.Header, bodyString(incomingRequest), closest.String(s.expectations), partialDefaults.String())
+			return nil
+		}
+		s.t.Fatalf("Unexpected call:\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v%v", r.Method, r.URL.Path, r.Header, bodyString(incomingRequest), closest.String(s.expectations))
+		return nil
 	}
 
-	if matchedExpectation.response == nil {
-		buf := bytes.Buffer{}
-		for _, val := range matchedExpectation.requestValidations {
-			buf.WriteString(fmt.Sprintf("----- %v\n", val.description))
+	incomingRequest.scope = matchedExpectation.owner
+
+	if sequence := matchedExpectation.sequence; s.strictResponseSequences && !matchedExpectation.cycle && len(sequence) > 0 && matchedExpectation.count > len(sequence) {
+		if _, ok := matchedExpectation.callResponses[matchedExpectation.count]; !ok {
+			matchedExpectation.t.Fatalf("Response sequence of %d responses exceeded by call %d of expectation:\n%v", len(sequence), matchedExpectation.count, validationList(matchedExpectation))
+			return nil
 		}
+	}
 
-		s.t.Fatalf("Response not defined for expectation:\n%v", buf.String())
-		return
+	matched := &matchedResponse{
+		exp:  matchedExpectation,
+		call: matchedExpectation.count,
+		resp: matchedExpectation.responseFor(matchedExpectation.count),
+	}
+	if matched.resp == nil {
+		matched.responseFunc = matchedExpectation.responseFunc
 	}
+	for _, reqVal := range matchedExpectation.requestValidations {
+		if reqVal.deferred(incomingRequest) {
+			streamValidations = append(streamValidations, streamValidation{t: matchedExpectation.t, val: reqVal})
+		}
+	}
+	matched.streamValidations = streamValidations
+	return matched
+}
 
-	// build response
-	for key, value := range matchedExpectation.response.Headers {
-		w.Header().Set(key, value)
+// matchedResponse is the expectation matched by an incoming request and the response of the matching call
+type matchedResponse struct {
+	exp  *requestExpectation
+	call int
+	resp *MockResponse
+	// responseFunc computes the response if no response is defined for the call (see ResponseFunc and Switch)
+	responseFunc func(in *IncomingRequest) *MockResponse
+	// streamValidations of the matched expectation and of EVERY read the unread body (see Opts.LazyBody)
+	streamValidations []streamValidation
+}
+
+// streamValidation is a validation of the unread body that runs after matching, its failure is reported to t
+type streamValidation struct {
+	t   T
+	val *requestValidation
+}
+
+// prepareResponse returns the response of the matched expectation to write, nil if the test failed
+// the response func is called without holding the handler lock, so it may use the mock server (e.g. Requests)
+func (s *mockServer) prepareResponse(matched *matchedResponse, incomingRequest *IncomingRequest) *MockResponse {
+	s.t.Helper()
+	// the unread body is streamed without holding the handler lock, so slow clients do not block other requests
+	var passed []*requestValidation
+	var exceeded *http.MaxBytesError
+	for _, stream := range matched.streamValidations {
+		err := stream.val.validation(incomingRequest)
+		if body, ok := incomingRequest.unreadBody.(*unreadBody); ok && body.exceeded != nil {
+			exceeded = body.exceeded
+			break
+		}
+		if err != nil {
+			stream.t.Errorf("expectation failed: %v", err)
+			continue
+		}
+		passed = append(passed, stream.val)
+	}
+
+	resp := matched.resp
+	if resp == nil && matched.responseFunc != nil && exceeded == nil {
+		resp = matched.exp.callResponseFunc(matched.responseFunc, incomingRequest)
 	}
 
-	w.WriteHeader(matchedExpectation.response.Code)
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
 
-	if matchedExpectation.response.Body != nil {
-		w.Write(matchedExpectation.response.Body)
+	for _, val := range passed {
+		val.satisfied = true
+	}
+	if exceeded != nil {
+		incomingRequest.BodyTruncated = true
+		return &MockResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			Body: []byte(fmt.Sprintf("request body exceeds %d bytes", exceeded.Limit)),
+		}
 	}
-}
 
-func (s *mockServer) EVERY() RequestExpectation {
-	exp := new(requestExpectation)
-	exp.t = s.t
-	exp.every = true
+	r := incomingRequest.R
+	matchedExpectation := matched.exp
+	if resp == nil {
+		matchedExpectation.t.Fatalf("Response not defined for expectation (call %d):\n%v", matched.call, validationList(matchedExpectation))
+		return nil
+	}
 
-	s.every = append(s.every, exp)
-	return exp
-}
+	// the status code is checked once more, a response func or a changed response may bypass the checks of the builders
+	if err := validMockResponse(resp); err != nil {
+		matchedExpectation.t.Errorf("invalid response: %v\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v", err, r.Method, r.URL.Path, r.Header, bodyString(incomingRequest))
+		resp = &MockResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte(fmt.Sprintf("invalid response: %v", err)),
+		}
+	}
 
-func (s *mockServer) EXPECT() RequestExpectation {
-	exp := &requestExpectation{
-		t:     s.t,
-		count: 0,
-		min:   1,
-		max:   1,
+	if resp.FailRate > 0 && s.rand.Float64() < resp.FailRate {
+		// a flaky failure only keeps the delay of the response
+		resp = &MockResponse{Code: resp.FailCode, Delay: resp.Delay, Jitter: resp.Jitter, DelayFunc: resp.DelayFunc}
 	}
 
-	s.expectations = append(s.expectations, exp)
-	return exp
+	resp = resp.copy()
+	if err := resp.render(incomingRequest, matched.call); err != nil {
+		matchedExpectation.t.Errorf("response template failed: %v\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v", err, r.Method, r.URL.Path, r.Header, bodyString(incomingRequest))
+		resp = &MockResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte(fmt.Sprintf("response template failed: %v", err)),
+		}
+	}
+	// the delay is drawn while holding the handler lock, the response is delayed by the caller without holding it
+	resp.Delay = s.delayFor(resp)
+	resp.Jitter, resp.DelayFunc = 0, nil
+	matchedExpectation.delays = append(matchedExpectation.delays, s.responseDelay+resp.Delay)
+	resp.served = s.served(matchedExpectation, matched.call)
+	resp.scope = matchedExpectation.owner
+	return resp
 }
 
-func (s *mockServer) DEFAULT() RequestExpectation {
-	exp := &requestExpectation{
-		t:          s.t,
-		defaultExp: true,
+// delayFor returns the delay of the response, Opts.ResponseDelay is added by writeResponse
+// random delays are drawn from Opts.Rand, which is guarded by the handler lock held by the caller
+func (s *mockServer) delayFor(resp *MockResponse) time.Duration {
+	delay := resp.Delay
+	if resp.DelayFunc != nil {
+		delay = resp.DelayFunc()
+	} else if resp.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(resp.Jitter) + 1))
 	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
 
-	s.defaults = append(s.defaults, exp)
-	return exp
+// strictValidation checks the headers of a strict expectation (see RequestExpectation.Strict and Opts.StrictMatching)
+// nil is returned for expectations that are not strict
+func (s *mockServer) strictValidation(exp *requestExpectation, in *IncomingRequest) error {
+	if !exp.strict && (!s.strictMatching || exp.every || exp.defaultExp) {
+		return nil
+	}
+	return strictHeadersValidation(exp.expectedHeaders)(in)
 }
 
-func (s *mockServer) AssertExpectations() {
-	s.t.Helper()
-	s.assertCalled = true
-	var buf bytes.Buffer
+// shadowedBy returns the expectation that is checked before exp and matched requests with the same or fewer validations
+// (e.g. two expectations with identical validations), nil if there is none
+func shadowedBy(exp *requestExpectation, expectations []*requestExpectation) *requestExpectation {
+	descriptions := make(map[string]bool, len(exp.requestValidations))
+	for _, val := range exp.requestValidations {
+		descriptions[val.description] = true
+	}
 
-	unsatisfied := false
-	for i, exp := range s.expectations {
-		showFirstUnmatched := false
-		if len(exp.requestValidations) == 0 {
-			unsatisfied = true
-			buf.WriteString(fmt.Sprintf("%v. Expectation\n", i+1))
-			buf.WriteString("----- no request validation defined\n")
+outer:
+	for _, other := range byPriority(expectations) {
+		if other == exp {
+			return nil
 		}
-		if exp.count < exp.min || exp.count > exp.max {
-			unsatisfied = true
-			buf.WriteString(fmt.Sprintf("%v. Expectation\n", i+1))
-			for _, val := range exp.requestValidations {
-				buf.WriteString(fmt.Sprintf("----- %v", val.description))
-				if !val.satisfied && !showFirstUnmatched {
-					showFirstUnmatched = true
-					buf.WriteString(" (never matched)")
-				}
-				buf.WriteString("\n")
-			}
-			if exp.count < exp.min {
-				buf.WriteString(fmt.Sprintf("----- only %v calls but at least %v were expected\n", exp.count, exp.min))
-			} else if exp.count > exp.max {
-				buf.WriteString(fmt.Sprintf("----- %v calls but at most %v were expected\n", exp.count, exp.max))
+		if other.owner != exp.owner || other.disabled || other.count == 0 || len(other.requestValidations) == 0 {
+			continue
+		}
+		for _, val := range other.requestValidations {
+			if !descriptions[val.description] {
+				continue outer
 			}
+		}
+		return other
+	}
+	return nil
+}
 
+// expectationNumber returns the number of the expectation as reported by AssertExpectations (starting at 1)
+func expectationNumber(exp *requestExpectation, expectations []*requestExpectation, owner *scopedServer) int {
+	i := 0
+	for _, other := range expectations {
+		if other.owner != owner {
+			continue
+		}
+		i++
+		if other == exp {
+			return i
 		}
 	}
+	return 0
+}
 
-	if unsatisfied {
-		s.t.Fatalf("\nexpectation(s) not satisfied:\n%v", buf.String())
+// closestMatch is the expectation that matched the most validations of an unexpected call and the validation that failed
+type closestMatch struct {
+	exp         *requestExpectation
+	matched     int
+	description string
+	err         error
+}
+
+// update replaces the closest match if exp matched more validations before failing, ties keep the first expectation
+// expectations that did not match a single validation are not considered
+func (c *closestMatch) update(exp *requestExpectation, matched int, description string, err error) {
+	if matched == 0 || matched <= c.matched {
 		return
 	}
+	c.exp, c.matched, c.description, c.err = exp, matched, description, err
+}
 
-	s.expectations = nil
+// String describes the closest match as an additional line of the unexpected call message, empty if there is none
+// the expectation is numbered like AssertExpectations does
+func (c *closestMatch) String(expectations []*requestExpectation) string {
+	if c.exp == nil {
+		return ""
+	}
+	return fmt.Sprintf("\nClosest match: expectation #%d failed at %v: %v", expectationNumber(c.exp, expectations, c.exp.owner), c.description, strings.TrimPrefix(c.err.Error(), "request validation failed: "))
 }
 
-func (s *mockServer) Shutdown() {
-	if !s.assertCalled {
-		s.t.Fatalf("AssertExpectations() was not called, no expectations were checked")
+// validationList lists the validations of the expectation, one per line
+func validationList(exp *requestExpectation) string {
+	buf := bytes.Buffer{}
+	for _, val := range exp.requestValidations {
+		buf.WriteString(fmt.Sprintf("----- %v\n", val.description))
+	}
+	return buf.String()
+}
+
+// defaultDescription describes a default by the validations that matched before the n-th validation failed (e.g. POST AND Path: /users)
+func defaultDescription(exp *requestExpectation, n int) string {
+	descriptions := make([]string, 0, n)
+	for _, val := range exp.requestValidations[:n] {
+		descriptions = append(descriptions, val.description)
+	}
+	return strings.Join(descriptions, " AND ")
+}
+
+// byPriority returns the expectations ordered by priority (higher first), ties keep their registration order
+func byPriority(expectations []*requestExpectation) []*requestExpectation {
+	sorted := make([]*requestExpectation, len(expectations))
+	copy(sorted, expectations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority > sorted[j].priority
+	})
+	return sorted
+}
+
+// writeResponse writes the mocked response to the client
+// it is called without holding the handler lock, so a stalled response does not block other requests
+func (s *mockServer) writeResponse(w http.ResponseWriter, r *http.Request, resp *MockResponse) {
+	if delay := s.responseDelay + resp.Delay; delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+
+	if resp.Fault != NoFault {
+		s.setLastResponse(resp)
+
+		if resp.Hang > 0 {
+			// the connection is closed when the client gives up or the server is shut down as well
+			timer := time.NewTimer(resp.Hang)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+			case <-s.done:
+			}
+			timer.Stop()
+		}
+
+		if resp.Raw != nil {
+			s.writeRaw(w, resp.Raw)
+			return
+		}
+		s.closeConnection(w, resp.Fault)
 		return
 	}
+
+	s.writeInterim(w, resp.Interim)
+
+	for key, value := range s.defaultResponseHeaders {
+		w.Header().Set(key, value)
+	}
+	for key, value := range resp.Headers {
+		w.Header().Set(key, value)
+	}
+	for key, values := range resp.HeaderValues {
+		w.Header().Del(key)
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	if _, ok := resp.Headers["Content-Type"]; resp.NoContentType && !ok && resp.HeaderValues.Get("Content-Type") == "" {
+		// a nil value keeps net/http from sniffing the content type
+		w.Header()["Content-Type"] = nil
+	}
+
+	s.setLastResponse(resp)
+
+	body, size := resp.body()
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if resp.TruncateBody || resp.OverrideContentLength {
+		s.writeMalformed(w, resp, body)
+		return
+	}
+
+	if resp.HTTP10 {
+		s.writeHTTP10(w, resp, body, size)
+		return
+	}
+
+	declareTrailers(w, resp)
+
+	if resp.Chunks != nil && !resp.Stall {
+		s.writeChunks(w, r, resp)
+		return
+	}
+
+	if resp.BodyReader != nil && size >= 0 && len(resp.Trailers) == 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(resp.Code)
+
+	if !resp.Stall {
+		s.copyBody(w, body, -1)
+		writeTrailers(w, resp)
+		return
+	}
+
+	s.copyBody(w, body, int64(resp.StallAfter))
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	// keep the connection open until the client gives up or the server is shut down
+	select {
+	case <-r.Context().Done():
+	case <-s.done:
+	}
+}
+
+// writeHTTP10 writes the response as HTTP/1.0 with the headers already set on w and closes the connection afterwards
+// the connection is hijacked and the status line is written manually, so the body is never chunked
+func (s *mockServer) writeHTTP10(w http.ResponseWriter, resp *MockResponse, body io.Reader, size int64) {
+	if rec, ok := w.(*transportRecorder); ok {
+		rec.http10 = true
+		w.WriteHeader(resp.Code)
+		s.copyBody(w, body, -1)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.t.Errorf("could not write HTTP/1.0 response: connection cannot be hijacked (e.g. http/2)")
+		return
+	}
+
+	header := w.Header().Clone()
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		s.t.Errorf("could not write HTTP/1.0 response: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// a body of unknown size is delimited by closing the connection
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	} else {
+		header.Del("Content-Length")
+	}
+	header.Set("Connection", "close")
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	fmt.Fprintf(buf, "HTTP/1.0 %03d %s\r\n", resp.Code, http.StatusText(resp.Code))
+	_ = header.Write(buf)
+	buf.WriteString("\r\n")
+	s.copyBody(buf, body, -1)
+	if err := buf.Flush(); err != nil {
+		s.t.Errorf("could not write HTTP/1.0 response: %v", err)
+	}
+}
+
+// writeChunks streams the chunks of the response with chunked transfer encoding, each chunk is flushed
+// and the chunk interval is waited between the chunks, the handler lock is not held while streaming
+func (s *mockServer) writeChunks(w http.ResponseWriter, r *http.Request, resp *MockResponse) {
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.Code)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		// flushing the header forces chunked transfer encoding, even for small bodies
+		flusher.Flush()
+	}
+
+	for i, chunk := range resp.Chunks {
+		if i > 0 && resp.ChunkInterval > 0 {
+			timer := time.NewTimer(resp.ChunkInterval)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			case <-s.done:
+				timer.Stop()
+				return
+			}
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if resp.TruncateStream {
+		s.closeConnection(w, CloseConnection)
+		return
+	}
+	writeTrailers(w, resp)
+}
+
+// declareTrailers announces the trailers of the response by the Trailer header, it must be called before the header is written
+// a Content-Length is removed, so the body is chunked and the trailers can be sent after it
+func declareTrailers(w http.ResponseWriter, resp *MockResponse) {
+	if len(resp.Trailers) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(resp.Trailers))
+	for key := range resp.Trailers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.Header().Del("Content-Length")
+	for _, key := range keys {
+		w.Header().Add("Trailer", key)
+	}
+}
+
+// writeTrailers sets the values of the declared trailers, they are sent after the body
+func writeTrailers(w http.ResponseWriter, resp *MockResponse) {
+	for key, value := range resp.Trailers {
+		w.Header().Set(key, value)
+	}
+}
+
+// copyBody streams the response body to the client with a bounded buffer, at most limit bytes are copied if limit is not negative
+// errors reading the body fail the test, write errors are ignored as the client may have gone away
+func (s *mockServer) copyBody(w io.Writer, body io.Reader, limit int64) {
+	src := &bodyReader{Reader: body}
+	var r io.Reader = src
+	if limit >= 0 {
+		r = io.LimitReader(src, limit)
+	}
+
+	_, _ = io.CopyBuffer(w, r, make([]byte, 32*1024))
+	if src.err != nil {
+		s.t.Errorf("response body could not be streamed: %v", src.err)
+	}
+}
+
+// bodyReader records the read error of a response body, so it can be told apart from write errors of the connection
+// it also hides io.WriterTo of the wrapped reader, so the body is copied with the bounded buffer of copyBody
+type bodyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// writeMalformed writes the response with a Content-Length that does not match the written body and closes the connection
+// (see ResponseExpectation.TruncateBodyAfter and OverrideContentLength), net/http would correct the Content-Length,
+// therefore the response is written to the hijacked connection
+func (s *mockServer) writeMalformed(w http.ResponseWriter, resp *MockResponse, body io.Reader) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		s.t.Errorf("response body could not be streamed: %v", err)
+	}
+
+	contentLength := int64(len(data))
+	if resp.OverrideContentLength {
+		contentLength = resp.ContentLength
+	}
+	if resp.TruncateBody && resp.TruncateAfter < len(data) {
+		data = data[:resp.TruncateAfter]
+	}
+
+	if rec, ok := w.(*transportRecorder); ok {
+		rec.http10 = resp.HTTP10
+		rec.contentLength = contentLength
+		rec.malformed = true
+		w.WriteHeader(resp.Code)
+		w.Write(data)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.t.Errorf("could not write malformed response: connection cannot be hijacked (e.g. http/2)")
+		return
+	}
+
+	header := w.Header().Clone()
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		s.t.Errorf("could not write malformed response: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	header.Set("Connection", "close")
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	proto := "HTTP/1.1"
+	if resp.HTTP10 {
+		proto = "HTTP/1.0"
+	}
+	fmt.Fprintf(buf, "%s %03d %s\r\n", proto, resp.Code, http.StatusText(resp.Code))
+	_ = header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(data)
+	_ = buf.Flush()
+}
+
+// writeInterim writes the informational (1xx) responses before the response (see ResponseExpectation.Informational)
+// their headers are removed afterwards, so they are not repeated by the response
+func (s *mockServer) writeInterim(w http.ResponseWriter, interim []InterimResponse) {
+	if _, ok := w.(*transportRecorder); ok {
+		// a round tripper does not return informational responses
+		return
+	}
+	for _, info := range interim {
+		for key, value := range info.Headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(info.Code)
+		for key := range info.Headers {
+			w.Header().Del(key)
+		}
+	}
+}
+
+// writeRaw writes the data verbatim to the hijacked connection and closes it (see RequestExpectation.RawBytes)
+func (s *mockServer) writeRaw(w http.ResponseWriter, data []byte) {
+	if rec, ok := w.(*transportRecorder); ok {
+		rec.raw = data
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.t.Errorf("could not write raw response: connection cannot be hijacked (e.g. http/2)")
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		s.t.Errorf("could not write raw response: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	buf.Write(data)
+	_ = buf.Flush()
+}
+
+// faultWriter is implemented by response writers that are not backed by a network connection (see transport)
+type faultWriter interface {
+	fault(fault ConnectionFault)
+}
+
+// closeConnection closes the connection of the request without writing a response
+func (s *mockServer) closeConnection(w http.ResponseWriter, fault ConnectionFault) {
+	if fw, ok := w.(faultWriter); ok {
+		fw.fault(fault)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		// connections that cannot be hijacked (e.g. http/2 streams) are aborted by the http server
+		panic(http.ErrAbortHandler)
+	}
+
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		s.t.Errorf("could not close connection: %v", err)
+		return
+	}
+
+	netConn := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := netConn.(*net.TCPConn); ok && fault == ResetConnection {
+		// a linger timeout of 0 discards unsent data and sends a RST instead of a FIN
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = netConn.Close()
+}
+
+func (s *mockServer) EVERY() RequestExpectation {
+	return s.registerEvery(s.t, nil)
+}
+
+func (s *mockServer) EXPECT() RequestExpectation {
+	return s.registerExpectation(s.t, nil)
+}
+
+func (s *mockServer) NthRequest(n int) RequestExpectation {
+	return s.registerNthRequest(s.t, nil, n)
+}
+
+func (s *mockServer) DEFAULT() RequestExpectation {
+	return s.registerDefault(s.t, nil)
+}
+
+func (s *mockServer) Disable(exp Expectation) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	exp.expectation().disabled = true
+}
+
+func (s *mockServer) Enable(exp Expectation) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	exp.expectation().disabled = false
+}
+
+func (s *mockServer) Remove(exp Expectation) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	removed := exp.expectation()
+	s.every = removeExpectation(s.every, removed)
+	s.expectations = removeExpectation(s.expectations, removed)
+	s.defaults = removeExpectation(s.defaults, removed)
+	if removed.group != nil {
+		removed.group.expectations = removeExpectation(removed.group.expectations, removed)
+	}
+}
+
+func (s *mockServer) Route(prefix string) Route {
+	return newRoute(s, s.t, nil, prefix)
+}
+
+func (s *mockServer) InOrder() OrderedGroup {
+	return &orderedGroup{server: s, t: s.t}
+}
+
+func (s *mockServer) Scoped(t T) MockServer {
+	return &scopedServer{mockServer: s, t: t}
+}
+
+func (s *mockServer) registerEvery(t T, owner *scopedServer) RequestExpectation {
+	exp := &requestExpectation{
+		t:     t,
+		mu:    &s.handlerMutex,
+		owner: owner,
+		every: true,
+	}
+	exp.register = func(clone *requestExpectation) {
+		s.every = append(s.every, clone)
+	}
+
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	s.every = append(s.every, exp)
+	return exp
+}
+
+func (s *mockServer) registerExpectation(t T, owner *scopedServer) RequestExpectation {
+	exp := &requestExpectation{
+		t:                  t,
+		mu:                 &s.handlerMutex,
+		owner:              owner,
+		prettyJSON:         s.prettyJSON,
+		sniffContentType:   s.sniffContentType,
+		defaultContentType: s.defaultContentType,
+		count:              0,
+		min:                1,
+		max:                1,
+	}
+	exp.register = func(clone *requestExpectation) {
+		s.expectations = append(s.expectations, clone)
+	}
+
 	s.handlerMutex.Lock()
 	defer s.handlerMutex.Unlock()
 
-	s.server.Close()
+	s.expectations = append(s.expectations, exp)
+	return exp
+}
+
+// registerNthRequest registers an expectation that only matches the n-th request received by the mock server
+func (s *mockServer) registerNthRequest(t T, owner *scopedServer, n int) RequestExpectation {
+	t.Helper()
+	if n < 1 {
+		// the expectation is registered anyway, so chained calls do not panic, it never matches since requests start at 1
+		t.Fatalf("NthRequest expects a request number starting at 1, got %d", n)
+	}
+
+	exp := s.registerExpectation(t, owner).(*requestExpectation)
+	return exp.appendHeadValidation(nthRequestValidation(n), fmt.Sprintf("NthRequest: %d", n))
+}
+
+func (s *mockServer) registerDefault(t T, owner *scopedServer) RequestExpectation {
+	exp := &requestExpectation{
+		t:                  t,
+		mu:                 &s.handlerMutex,
+		owner:              owner,
+		defaultExp:         true,
+		prettyJSON:         s.prettyJSON,
+		sniffContentType:   s.sniffContentType,
+		defaultContentType: s.defaultContentType,
+	}
+	exp.register = func(clone *requestExpectation) {
+		s.defaults = append(s.defaults, clone)
+	}
+
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	s.defaults = append(s.defaults, exp)
+	return exp
+}
+
+func (s *mockServer) AssertExpectations() {
+	s.t.Helper()
+	s.assertCalled = true
+	s.assertExpectations(s.t, nil)
+}
+
+// assertExpectations checks all expectations registered by the given owner (nil for the mock server itself)
+// and removes them if they are satisfied
+func (s *mockServer) assertExpectations(t T, owner *scopedServer) {
+	t.Helper()
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	if cycle := findAfterCycle(s.expectations, owner); cycle != "" {
+		t.Fatalf("\ncyclic After() dependency between expectations:\n%v", cycle)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	unsatisfied := false
+	i := 0
+	for _, exp := range s.expectations {
+		if exp.owner != owner {
+			continue
+		}
+		i++
+
+		showFirstUnmatched := false
+		if len(exp.requestValidations) == 0 {
+			unsatisfied = true
+			buf.WriteString(fmt.Sprintf("%v. Expectation\n", i))
+			buf.WriteString("----- no request validation defined\n")
+		}
+		sequenceUnused := len(exp.sequence) > 0 && exp.count < len(exp.sequence)
+		if exp.count < exp.min || exp.count > exp.max || sequenceUnused {
+			unsatisfied = true
+			buf.WriteString(fmt.Sprintf("%v. Expectation\n", i))
+
+			var shadow *requestExpectation
+			if s.detectAmbiguous && exp.count < exp.min {
+				shadow = shadowedBy(exp, s.expectations)
+				// the validations of a shadowed expectation are not checked at all, so none is reported as never matched
+				showFirstUnmatched = shadow != nil
+			}
+			for _, val := range exp.requestValidations {
+				buf.WriteString(fmt.Sprintf("----- %v", val.description))
+				if !val.satisfied && !showFirstUnmatched {
+					showFirstUnmatched = true
+					buf.WriteString(" (never matched)")
+				}
+				buf.WriteString("\n")
+			}
+			if exp.strictViolation != "" {
+				buf.WriteString(fmt.Sprintf("----- Strict: %v\n", exp.strictViolation))
+			}
+			if shadow != nil {
+				buf.WriteString(fmt.Sprintf("----- ambiguous: shadowed by expectation %v (%v), which is checked first and matches the same requests\n", expectationNumber(shadow, s.expectations, owner), defaultDescription(shadow, len(shadow.requestValidations))))
+			}
+			if exp.never || exp.max == 0 {
+				buf.WriteString(fmt.Sprintf("----- expected never, but was called %v times\n", exp.count))
+			} else if exp.count < exp.min {
+				buf.WriteString(fmt.Sprintf("----- only %v calls but at least %v were expected\n", exp.count, exp.min))
+			} else if exp.count > exp.max {
+				buf.WriteString(fmt.Sprintf("----- %v calls but at most %v were expected\n", exp.count, exp.max))
+			}
+			if sequenceUnused {
+				buf.WriteString(fmt.Sprintf("----- only %v of %v responses of the sequence were used\n", exp.count, len(exp.sequence)))
+			}
+
+		}
+	}
+
+	// ordering violations are reported per ordered group, independently of the call counts
+	var groups []*orderedGroup
+	for _, exp := range s.expectations {
+		if exp.owner != owner || exp.group == nil || containsGroup(groups, exp.group) {
+			continue
+		}
+		groups = append(groups, exp.group)
+	}
+	for i, group := range groups {
+		if len(group.violations) == 0 {
+			continue
+		}
+		unsatisfied = true
+		buf.WriteString(fmt.Sprintf("Ordered group %v\n", i+1))
+		for _, violation := range group.violations {
+			buf.WriteString(fmt.Sprintf("----- out of order: %v\n", violation))
+		}
+	}
+
+	if unsatisfied {
+		t.Fatalf("\nexpectation(s) not satisfied:\n%v", buf.String())
+		return
+	}
+
+	s.expectations = removeOwned(s.expectations, owner)
+	// a scope ends with its assertion, so its every and default expectations are removed as well
+	if owner != nil {
+		s.every = removeOwned(s.every, owner)
+		s.defaults = removeOwned(s.defaults, owner)
+	}
+}
+
+// findAfterCycle returns a description of a cyclic After() dependency between the expectations of owner (empty if there is none)
+func findAfterCycle(expectations []*requestExpectation, owner *scopedServer) string {
+	positions := make(map[*requestExpectation]int)
+	for _, exp := range expectations {
+		if exp.owner == owner {
+			positions[exp] = len(positions) + 1
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*requestExpectation]int)
+	var path []*requestExpectation
+
+	var visit func(exp *requestExpectation) []*requestExpectation
+	visit = func(exp *requestExpectation) []*requestExpectation {
+		state[exp] = visiting
+		path = append(path, exp)
+		for _, prerequisite := range exp.after {
+			switch state[prerequisite] {
+			case visiting:
+				for i, pathExp := range path {
+					if pathExp == prerequisite {
+						return append(append([]*requestExpectation{}, path[i:]...), prerequisite)
+					}
+				}
+			case unvisited:
+				if cycle := visit(prerequisite); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[exp] = visited
+		return nil
+	}
+
+	for _, exp := range expectations {
+		if exp.owner != owner || state[exp] != unvisited {
+			continue
+		}
+
+		cycle := visit(exp)
+		if cycle == nil {
+			continue
+		}
+
+		var buf bytes.Buffer
+		for _, cycleExp := range cycle {
+			buf.WriteString(fmt.Sprintf("----- %v. Expectation", positions[cycleExp]))
+			if len(cycleExp.requestValidations) > 0 {
+				buf.WriteString(fmt.Sprintf(" (%v)", cycleExp.requestValidations[0].description))
+			}
+			buf.WriteString("\n")
+		}
+		return buf.String()
+	}
+	return ""
+}
+
+// removeExpectation returns the given expectations without removed
+func removeExpectation(expectations []*requestExpectation, removed *requestExpectation) []*requestExpectation {
+	var remaining []*requestExpectation
+	for _, exp := range expectations {
+		if exp != removed {
+			remaining = append(remaining, exp)
+		}
+	}
+	return remaining
+}
+
+// removeOwned returns the given expectations without the ones registered by owner
+func removeOwned(expectations []*requestExpectation, owner *scopedServer) []*requestExpectation {
+	var remaining []*requestExpectation
+	for _, exp := range expectations {
+		if exp.owner != owner {
+			remaining = append(remaining, exp)
+		}
+	}
+	return remaining
+}
+
+func (s *mockServer) Requests() []*CapturedRequest {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	captured := make([]*CapturedRequest, 0, len(s.requests))
+	for _, in := range s.requests {
+		captured = append(captured, &CapturedRequest{t: s.t, in: in})
+	}
+	return captured
+}
+
+func (s *mockServer) WaitForRequests(n int, timeout time.Duration) error {
+	return s.waitForRequests(n, timeout, func() int {
+		return len(s.requests)
+	})
+}
+
+// waitForRequests waits until count reports at least n requests, count is called while holding the handler lock
+func (s *mockServer) waitForRequests(n int, timeout time.Duration, count func() int) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.handlerMutex.Lock()
+		received, requestReceived := count(), s.requestReceived
+		s.handlerMutex.Unlock()
+
+		if received >= n {
+			return nil
+		}
+
+		select {
+		case <-requestReceived:
+		case <-timer.C:
+			return fmt.Errorf("received %d of %d requests within %v", received, n, timeout)
+		}
+	}
+}
+
+func (s *mockServer) LastRequest() *CapturedRequest {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	if len(s.requests) == 0 {
+		return nil
+	}
+	return &CapturedRequest{t: s.t, in: s.requests[len(s.requests)-1]}
+}
+
+// setLastResponse records the written response for LastResponse of the mock server and of the scope that produced it
+func (s *mockServer) setLastResponse(resp *MockResponse) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	s.lastResponse = resp
+	if resp.scope != nil {
+		resp.scope.lastResponse = resp
+	}
+}
+
+func (s *mockServer) LastResponse() *MockResponse {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	if s.lastResponse == nil {
+		return nil
+	}
+	return s.lastResponse.copy()
+}
+
+func (s *mockServer) Shutdown() {
+	if !s.assertCalled {
+		s.t.Fatalf("AssertExpectations() was not called, no expectations were checked")
+		return
+	}
+	s.shutdownOnce.Do(func() {
+		close(s.done)
+
+		s.handlerMutex.Lock()
+		defer s.handlerMutex.Unlock()
+
+		s.server.Close()
+	})
 }
@@ -0,0 +1,99 @@
+package httpmockserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// MatchField selects an aspect of an example request that is matched by an expectation (see RequestExpectation.LikeRequest)
+type MatchField struct {
+	kind    matchFieldKind
+	headers []string
+}
+
+type matchFieldKind int
+
+const (
+	matchMethod matchFieldKind = iota
+	matchPath
+	matchQuery
+	matchHeaders
+	matchBody
+)
+
+var (
+	// MatchMethod matches the method of the example request
+	MatchMethod = MatchField{kind: matchMethod}
+	// MatchPath matches the exact path of the example request (a path prefix of a Route is not applied)
+	MatchPath = MatchField{kind: matchPath}
+	// MatchQuery matches all query parameters of the example request (parameters with an empty value are ignored)
+	MatchQuery = MatchField{kind: matchQuery}
+	// MatchBody matches the exact body of the example request
+	MatchBody = MatchField{kind: matchBody}
+)
+
+// MatchHeaders matches the given headers of the example request (e.g. "Content-Type", "X-Request-Id")
+// every header has to be set on the example request
+func MatchHeaders(names ...string) MatchField {
+	return MatchField{kind: matchHeaders, headers: names}
+}
+
+// likeRequest translates the selected fields of the example request into validations of the expectation
+// the body of the example request is restored, so it can still be read by the caller
+func (exp *requestExpectation) likeRequest(req *http.Request, fields []MatchField) {
+	exp.t.Helper()
+	for _, field := range fields {
+		switch field.kind {
+		case matchMethod:
+			exp.Method(req.Method)
+		case matchPath:
+			exp.appendValidation(pathValidation(req.URL.Path), "Path: "+req.URL.Path)
+		case matchQuery:
+			query := req.URL.Query()
+			keys := make([]string, 0, len(query))
+			for key := range query {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				if value := query.Get(key); value != "" {
+					exp.QueryParameter(key, value)
+				}
+			}
+		case matchHeaders:
+			for _, name := range field.headers {
+				value := req.Header.Get(name)
+				if value == "" {
+					exp.t.Fatalf("LikeRequest: header %v is not set on the example request", name)
+					return
+				}
+				exp.Header(name, value)
+			}
+		case matchBody:
+			body, ok := exp.copyBody(req)
+			if !ok {
+				return
+			}
+			exp.Body(body)
+		}
+	}
+}
+
+// copyBody reads the body of the given request and replaces it with an unread copy
+func (exp *requestExpectation) copyBody(req *http.Request) ([]byte, bool) {
+	exp.t.Helper()
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, true
+	}
+
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		exp.t.Fatalf("LikeRequest: could not read body of example request: %v", err)
+		return nil, false
+	}
+	return body, true
+}
@@ -0,0 +1,61 @@
+package httpmockserver
+
+// OrderedGroup is used to create expectations that must be matched in the order they were declared
+// (e.g. POST /login has to be called before GET /data)
+type OrderedGroup interface {
+	// EXPECT returns a RequestExpectation that belongs to the ordered group
+	// it only matches if all expectations declared before it in the group are satisfied (reached their minimum number of calls)
+	// otherwise the request is treated as unmatched and reported as ordering violation by AssertExpectations
+	EXPECT() RequestExpectation
+}
+
+type orderedGroup struct {
+	server *mockServer
+	t      T
+	// owner is the scope that created the group (nil for the mock server itself)
+	owner        *scopedServer
+	expectations []*requestExpectation
+	// violations contains a description of each request that matched an expectation out of order
+	violations []string
+}
+
+func (g *orderedGroup) EXPECT() RequestExpectation {
+	exp := g.server.registerExpectation(g.t, g.owner).(*requestExpectation)
+
+	defer exp.lock()()
+	exp.group = g
+	g.expectations = append(g.expectations, exp)
+	return exp
+}
+
+// unsatisfiedBefore returns the first expectation declared before exp that did not reach its minimum number of calls
+func (g *orderedGroup) unsatisfiedBefore(exp *requestExpectation) *requestExpectation {
+	for _, previous := range g.expectations {
+		if previous == exp {
+			return nil
+		}
+		if previous.count < previous.min {
+			return previous
+		}
+	}
+	return nil
+}
+
+// position returns the 1-based position of exp within the group
+func (g *orderedGroup) position(exp *requestExpectation) int {
+	for i, groupExp := range g.expectations {
+		if groupExp == exp {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func containsGroup(groups []*orderedGroup, group *orderedGroup) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
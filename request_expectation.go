@@ -1,14 +1,89 @@
 package httpmockserver
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"io"
 	"math"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type IncomingRequest struct {
 	R    *http.Request
 	Body []byte
+	// Query contains the parsed query parameters of the request url
+	Query url.Values
+	// Form contains the parsed query parameters and form body parameters (see http.Request.Form)
+	Form url.Values
+	// PostForm contains the parsed form body parameters of POST, PUT and PATCH requests (see http.Request.PostForm)
+	PostForm url.Values
+	// PathParams contains the named path segments extracted by PathParams (e.g. {"id": "123"} for /users/:id)
+	PathParams map[string]string
+	// BodyMatches contains the match of StringBodyMatches followed by its capture groups (see regexp.FindStringSubmatch)
+	BodyMatches []string
+	// ReceivedAt is the time the request arrived at the mock server, before its body was read (see Opts.Clock)
+	ReceivedAt time.Time
+	// BodyTruncated is set if the body exceeded Opts.MaxBodyBytes, Body then only contains the bytes read up to the limit
+	BodyTruncated bool
+
+	// formErr is the error of parsing the form parameters, it fails form validations only
+	formErr error
+	// unreadBody is the request body left unread by Opts.LazyBody, see BodyReader
+	unreadBody io.Reader
+	// number is the position of the request among all requests received by the mock server (starting at 1, see NthRequest)
+	number int
+	// scope is the scope of the expectation that matched the request (nil for the mock server itself, see Requests)
+	scope *scopedServer
+
+	clock func() time.Time
+	// verbose prints complete bodies in failure messages (see Opts.VerboseMismatch)
+	verbose bool
+	// ignoredHeaders are accepted by Strict and HeadersExactly in addition to the default ones (see Opts.IgnoredHeaders)
+	ignoredHeaders map[string]bool
+
+	jsonOnce  sync.Once
+	jsonValue interface{}
+	jsonErr   error
+}
+
+// JSON returns the body decoded as json (see encoding/json), the body is decoded only once
+// the returned value is shared, so it must not be modified
+func (in *IncomingRequest) JSON() (interface{}, error) {
+	in.jsonOnce.Do(func() {
+		in.jsonErr = json.Unmarshal(in.Body, &in.jsonValue)
+	})
+	return in.jsonValue, in.jsonErr
+}
+
+// BodyReader returns a reader of the request body for streaming validations (see RequestExpectation.BodyStreamFunc)
+// if the body was left unread (see Opts.LazyBody), the returned reader streams it from the connection and can only be consumed once
+func (in *IncomingRequest) BodyReader() io.Reader {
+	if in.unreadBody != nil {
+		return in.unreadBody
+	}
+	return bytes.NewReader(in.Body)
+}
+
+// headerIgnored checks if the header is accepted by Strict and HeadersExactly without being expected
+func (in *IncomingRequest) headerIgnored(name string) bool {
+	return ignoredHeaders[name] || in.ignoredHeaders[name]
+}
+
+// Now returns the current time of the mock server clock (see Opts.Clock)
+func (in *IncomingRequest) Now() time.Time {
+	if in.clock == nil {
+		return time.Now()
+	}
+	return in.clock()
 }
 
 // RequestExpectation is used to set expectations on incoming requests
@@ -16,6 +91,8 @@ type IncomingRequest struct {
 // EXPECT(): used to set expectations that are checked on a specific request (specified number of times)
 // DEFAULT(): used to set expectations that are checked on a request if no other expectation matches
 type RequestExpectation interface {
+	Expectation
+
 	// AnyTimes expects a given request any number of times (same as MinTimes(0).MaxTimes(∞))
 	AnyTimes() RequestExpectation
 	// Once expects a given request exactly once (same as Times(1))
@@ -32,17 +109,43 @@ type RequestExpectation interface {
 	MinTimes(n int) RequestExpectation
 	// MaxTimes expects a given request at most n times (decreases MinTimes to at least n)
 	MaxTimes(n int) RequestExpectation
+	// After expects a given request only after the given expectations are satisfied (reached their minimum number of calls)
+	// a request arriving earlier does not match this expectation (e.g. GET /data only after POST /login)
+	// the prerequisites may be given as RequestExpectation or as the ResponseExpectation returned by Response()
+	After(prerequisites ...Expectation) RequestExpectation
+	// Never expects a given request not to be called at all (same as Times(0), but no Response is required)
+	// a matching request is counted and reported as failure, the response is produced by other expectations or defaults
+	// it only sees requests that were not matched by an expectation checked before it (see Priority)
+	Never() RequestExpectation
+	// Priority sets the priority of the expectation (default: 0)
+	// expectations with a higher priority are matched first, ties are matched in registration order
+	Priority(n int) RequestExpectation
+	// Strict rejects requests with headers that are not checked by a validation of the expectation
+	// (e.g. Header, HeaderExists, BasicAuth), headers set by http clients automatically are allowed
+	// (Host, Content-Length, Content-Type, User-Agent, Accept-Encoding, Connection), see Opts.StrictMatching
+	Strict() RequestExpectation
+	// Clone registers a new expectation of the same kind (EXPECT, DEFAULT or EVERY) with a copy of the validations,
+	// the number of expected calls, Priority, After, Never and Strict of this expectation (e.g. to derive several
+	// expectations from a base expectation with common headers or auth), responses and ordered groups are not copied
+	Clone() RequestExpectation
 
 	// Request expects a given request with a specific method and path
 	Request(method string, path string) RequestExpectation
 	// RequestMatches expects a given request with a specific method and path matching a regex (e.g. `^/foo/bar/\d+$`)
 	RequestMatches(method string, pathRegex string) RequestExpectation
 	// Method expects a given request with a specific method (e.g. GET, POST, PUT, DELETE)
+	// the method is compared case-insensitively, so Method("get") matches GET and get requests
 	Method(method string) RequestExpectation
+	// MethodExact expects a given request with exactly the given method, the method is compared case-sensitively
+	// (e.g. to assert the casing on the wire, MethodExact("GET") does not match a get request)
+	MethodExact(method string) RequestExpectation
 	// Path expects a given request with a specific path (e.g. /foo/bar)
 	Path(path string) RequestExpectation
 	// PathMatches expects a given request with a path matching a regex (e.g. `^/foo/bar/\d+$`)
 	PathMatches(pathRegex string) RequestExpectation
+	// PathParams expects a given request with a path matching a pattern with named segments (e.g. /users/:id/posts/:postID)
+	// the extracted values are available in IncomingRequest.PathParams
+	PathParams(pattern string) RequestExpectation
 
 	// GET expects a given request with a GET method
 	// use if no path should be matched (otherwise use Get(path))
@@ -62,6 +165,15 @@ type RequestExpectation interface {
 	// HEAD expects a given request with a HEAD method
 	// use if no path should be matched (otherwise use Head(path))
 	HEAD() RequestExpectation
+	// OPTIONS expects a given request with a OPTIONS method
+	// use if no path should be matched (otherwise use Options(path))
+	OPTIONS() RequestExpectation
+	// TRACE expects a given request with a TRACE method
+	// use if no path should be matched (otherwise use Trace(path))
+	TRACE() RequestExpectation
+	// CONNECT expects a given request with a CONNECT method
+	// use if no path should be matched (otherwise use Connect(path))
+	CONNECT() RequestExpectation
 
 	// Get expects a given request with a GET method and a specific path (e.g. /foo/bar)
 	Get(path string) RequestExpectation
@@ -87,15 +199,55 @@ type RequestExpectation interface {
 	Head(path string) RequestExpectation
 	// HeadMatches expects a given request with a HEAD method and a path matching a regex (e.g. `^/foo/bar/\d+$`)
 	HeadMatches(pathRegex string) RequestExpectation
+	// Options expects a given request with a OPTIONS method and a specific path (e.g. /foo/bar)
+	Options(path string) RequestExpectation
+	// OptionsMatches expects a given request with a OPTIONS method and a path matching a regex (e.g. `^/foo/bar/\d+$`)
+	OptionsMatches(pathRegex string) RequestExpectation
+	// Trace expects a given request with a TRACE method and a specific path (e.g. /foo/bar)
+	Trace(path string) RequestExpectation
+	// TraceMatches expects a given request with a TRACE method and a path matching a regex (e.g. `^/foo/bar/\d+$`)
+	TraceMatches(pathRegex string) RequestExpectation
+	// Connect expects a given request with a CONNECT method and a specific path (e.g. /foo/bar)
+	Connect(path string) RequestExpectation
+	// ConnectMatches expects a given request with a CONNECT method and a path matching a regex (e.g. `^/foo/bar/\d+$`)
+	ConnectMatches(pathRegex string) RequestExpectation
 
 	// Header expects a given request with a specific header (e.g. "Content-Type", "application/json")
 	Header(name, value string) RequestExpectation
 	// HeaderMatches expects a given request with a header matching a regex (e.g. "Content-Type", `^application/(json|xml)$`)
 	HeaderMatches(name, valueRegex string) RequestExpectation
+	// HeaderFold expects a given request with a specific header compared case-insensitively (e.g. "Authorization", "bearer abc")
+	// in contrast to HeaderMatches no regex is used, the value is compared using strings.EqualFold
+	HeaderFold(name, value string) RequestExpectation
 	// HeaderExists expects a given request with a specific header (e.g. "Authorization")
 	HeaderExists(name string) RequestExpectation
+	// Trailer expects a given request with a specific trailer sent after a chunked body (e.g. "Grpc-Status", "0")
+	Trailer(name, value string) RequestExpectation
+	// Accepts expects a given request with an Accept header that accepts the given media type (e.g. "application/json")
+	// wildcards like "*/*" or "application/*" are respected, media ranges with q=0 are ignored
+	Accepts(mediaType string) RequestExpectation
+	// CORSPreflight expects a CORS preflight request: an OPTIONS request with the given Origin header
+	// and an Access-Control-Request-Method header (use together with ResponseExpectation.CORS)
+	CORSPreflight(origin string) RequestExpectation
+	// Referer expects a given request with a specific Referer header (e.g. "https://example.com/page")
+	// the misspelled "Referrer" header is used as fallback if no Referer header is set
+	Referer(value string) RequestExpectation
+	// RefererMatches expects a given request with a Referer header matching a regex (e.g. `^https://example\.com/`)
+	RefererMatches(regex string) RequestExpectation
+	// TLS expects a given request received over TLS (see Opts.UseSSL)
+	TLS() RequestExpectation
+	// TLSMinVersion expects a given request received over TLS with at least the given version (e.g. tls.VersionTLS12)
+	TLSMinVersion(version uint16) RequestExpectation
+	// RemoteAddr expects a given request from a specific remote ip (e.g. "127.0.0.1"), the port of the client is ignored
+	RemoteAddr(ip string) RequestExpectation
+	// ForwardedFor expects a given request with an X-Forwarded-For chain containing the given ip (e.g. "203.0.113.7")
+	ForwardedFor(ip string) RequestExpectation
 	// Headers expects a given request with specific list of headers
 	Headers(map[string]string) RequestExpectation
+	// HeadersExactly expects a given request with specific list of headers and no other headers
+	// headers set by http clients automatically (e.g. User-Agent, Content-Type) and hop-by-hop headers are ignored,
+	// further headers can be ignored by Opts.IgnoredHeaders
+	HeadersExactly(headers map[string]string) RequestExpectation
 
 	// FormParameter expects a given request with a specific form parameter (e.g. "foo", "bar")
 	FormParameter(name, value string) RequestExpectation
@@ -105,6 +257,9 @@ type RequestExpectation interface {
 	FormParameterExists(name string) RequestExpectation
 	// FormParameters expects a given request with specific list of form parameters
 	FormParameters(map[string]string) RequestExpectation
+	// FormParameterValues expects a given request with a form parameter containing exactly the given values in any order
+	// (e.g. "foo", []string{"bar", "baz"} for "foo=bar&foo=baz")
+	FormParameterValues(name string, values []string) RequestExpectation
 
 	// QueryParameter expects a given request with a specific query parameter (e.g. "?foo=bar")
 	QueryParameter(name, value string) RequestExpectation
@@ -114,18 +269,48 @@ type RequestExpectation interface {
 	QueryParameterExists(name string) RequestExpectation
 	// QueryParameters expects a given request with specific list of query parameters
 	QueryParameters(map[string]string) RequestExpectation
+	// QueryParametersExactly expects a given request with exactly the given query parameters
+	// in contrast to QueryParameters any other query parameter (or a repeated one) fails the validation
+	QueryParametersExactly(map[string]string) RequestExpectation
+	// RawQuery expects a given request with exactly the given encoded query string (without "?"), e.g. "b=2&a=%20x"
+	// in contrast to the query parameter matchers the order and the encoding of the parameters are compared byte by byte
+	RawQuery(expected string) RequestExpectation
+	// RawQueryMatches expects a given request with an encoded query string matching a regex (e.g. `^page=\d+$`)
+	RawQueryMatches(regex string) RequestExpectation
 
 	// BasicAuth expects a given request with a specific basic auth username and password
 	BasicAuth(user, password string) RequestExpectation
 	// BasicAuthExists expects a given request with basic auth
 	BasicAuthExists() RequestExpectation
 
+	// OAuth2ClientCredentials expects an OAuth2 client credentials token request:
+	// a POST request with the form parameter grant_type=client_credentials and the given client credentials
+	// either as basic auth or as client_id / client_secret form parameters (use together with ResponseExpectation.OAuth2TokenResponse)
+	OAuth2ClientCredentials(clientID, clientSecret string) RequestExpectation
+
 	// JWTTokenExists expects a given request with a jwt auth token
 	JWTTokenExists() RequestExpectation
 	// JWTTokenClaimPath expects a given request with a jwt auth token containing a specific claim using jsonPath notation
 	// (e.g. `$.foo.bar` for `{"foo":{"bar":"baz"}}`)
 	// see: https://github.com/oliveagle/jsonpath
 	JWTTokenClaimPath(jsonPath string, value interface{}) RequestExpectation
+	// JWTTokenClaimMatches expects a given request with a jwt auth token containing a claim matching a regex using jsonPath notation
+	// the claim is stringified before matching (e.g. `$.iat`, `^\d+$`)
+	// see: https://github.com/oliveagle/jsonpath
+	JWTTokenClaimMatches(jsonPath string, valueRegex string) RequestExpectation
+	// JWTTokenClaims expects a given request with a jwt auth token containing all the given top level claims
+	// numbers are compared by value and nested maps are compared structurally (e.g. map[string]interface{}{"sub": "123", "admin": true})
+	JWTTokenClaims(claims map[string]interface{}) RequestExpectation
+
+	// JWTTokenNotExpired expects a given request with a jwt auth token whose exp claim lies in the future
+	// and whose nbf claim, if present, does not lie in the future
+	// the current time is taken from Opts.Clock
+	JWTTokenNotExpired() RequestExpectation
+	// JWTTokenExpiresWithin expects a given request with a jwt auth token that is not expired
+	// but expires within the given duration (e.g. 5*time.Minute)
+	JWTTokenExpiresWithin(d time.Duration) RequestExpectation
+	// JWTTokenIssuedWithin expects a given request with a jwt auth token whose iat claim lies within the given duration before now
+	JWTTokenIssuedWithin(d time.Duration) RequestExpectation
 
 	// Body expects a given request with a specific body in bytes (e.g. []byte(`{"foo":"bar"}`))
 	Body(body []byte) RequestExpectation
@@ -135,52 +320,266 @@ type RequestExpectation interface {
 	StringBodyContains(substring string) RequestExpectation
 	// StringBodyMatches expects a given request with a body matching a regex (e.g. `^abcd\d+$`)
 	StringBodyMatches(regex string) RequestExpectation
+	// BodyMatches expects a given request with a raw body matching a regex (e.g. `^GIF8[79]a` for a gif magic number)
+	// the regex is applied to the raw bytes without converting them to a string, invalid UTF-8 bytes match \x{FFFD}
+	// the regex is compiled immediately, an invalid regex fails the test
+	BodyMatches(regex string) RequestExpectation
 	// JSONBody expects a given request with a specific body.
 	// The body can be either a go object that wil be parsed to a json string (e.g. `map[string]string{"foo":"bar"}`)
 	// or a json string (e.g. `{"foo":"bar"}`).
-	// The body will be normalized (e.g. whitespace will be removed, fields will be sorted) and compared by string equality.
+	// The body will be normalized (e.g. whitespace will be removed, fields will be sorted) and compared field by field,
+	// a mismatch lists the json path of each differing field.
 	JSONBody(object interface{}) RequestExpectation
+	// YAMLBody expects a given request with a specific yaml body.
+	// The body can be either a go object that will be parsed to a yaml string (e.g. `map[string]string{"foo":"bar"}`)
+	// or a yaml string (e.g. "foo: bar").
+	// Both bodies will be normalized and compared, a diff is reported on mismatch.
+	YAMLBody(object interface{}) RequestExpectation
+	// ExpectBody expects a given request with a specific body compared according to the Content-Type of the request.
+	// json and yaml bodies are compared like JSONBody and YAMLBody, xml bodies are compared ignoring whitespace,
+	// comments and attribute order, form bodies are compared by their values (string, url.Values or map[string]string).
+	// Bodies of any other content type are compared byte by byte (string or []byte).
+	ExpectBody(expected interface{}) RequestExpectation
+	// ProtoBody expects a given request with a protobuf body equal to the given message (compared using proto.Equal)
+	// the body is decoded according to the Content-Type: grpc, grpc-web(-text) and connect streaming bodies are unwrapped
+	// from their message frame, json bodies (e.g. Connect with application/json) are decoded using protojson
+	// and all other bodies are decoded as binary protobuf (e.g. application/proto)
+	ProtoBody(msg proto.Message) RequestExpectation
 	// JSONPathContains expects a given request with a body containing a specific json value using jsonPath notation
+	// numbers are compared by value, so any go number type matches a json number (e.g. 123, int64(123) or 123.0)
 	// see: https://github.com/oliveagle/jsonpath
 	JSONPathContains(jsonPath string, value interface{}) RequestExpectation
+	// JSONBodyContains expects a given request with a json body containing at least the fields of the given object
+	// (a go object or a json string) with the same values, additional fields are ignored at any level (e.g. server-added timestamps)
+	// arrays have to contain the same elements in the same order, objects within arrays are compared the same way
+	JSONBodyContains(expected interface{}) RequestExpectation
+	// StrictJSONBodyContains expects a given request with a json body containing exactly the fields of the given document
+	// (a go object or a json string), fields missing in the expected document are not allowed at any level
+	// and arrays have to contain the same elements in the same order, a mismatch names the json path (e.g. $.items[2].price)
+	// unlike JSONBody, numbers have to be of the same kind: an integer (10) does not match a decimal number (10.0)
+	StrictJSONBodyContains(expected interface{}) RequestExpectation
 	// JSONPathMatches expects a given request with a body matching a regex of a value retrieved by jsonPath notation
 	// see: https://github.com/oliveagle/jsonpath
 	JSONPathMatches(jsonPath string, regex string) RequestExpectation
 
+	// ContentLengthMatchesBody expects a given request with a Content-Length header that equals the actual body length
+	// requests without a declared length (e.g. chunked transfer encoding) are not checked
+	ContentLengthMatchesBody() RequestExpectation
+	// BodyLength expects a given request with a body of exactly n bytes
+	BodyLength(n int) RequestExpectation
+	// BodyLengthBetween expects a given request with a body length between min and max bytes (inclusive)
+	BodyLengthBetween(min, max int) RequestExpectation
+	// MultipartFieldCount expects a given multipart request with exactly n text fields (parts without a file name)
+	MultipartFieldCount(n int) RequestExpectation
+	// MultipartFileCount expects a given multipart request with exactly n file parts (e.g. for bulk uploads)
+	MultipartFileCount(n int) RequestExpectation
+
 	// BodyFunc expects a given request with a custom validation function
 	// you can use the provided body to do arbitrary validation
 	// return nil if the request matched the given requirements
 	// if an error is returned, another expectation is tried (or the default expectation is used, if any)
 	BodyFunc(func(body []byte) error) RequestExpectation
 
+	// BodyStreamFunc expects a given request with a custom validation function that reads the body as a stream
+	// with Opts.LazyBody it does not force the body to be buffered, but the unbuffered body can only be read once,
+	// therefore the request is matched by the other validations and the stream is validated afterwards:
+	// a failing stream validation then fails the test instead of trying another expectation
+	BodyStreamFunc(func(body io.Reader) error) RequestExpectation
+
 	// Custom expects a given request with a custom validation function
 	// return nil if the request matched the given requirements
 	// if an error is returned, another expectation is tried (or the default expectation is used, if any)
 	Custom(validation RequestValidationFunc, description string) RequestExpectation
+	// RequestFunc expects a given request with a custom validation function like Custom,
+	// but without a description (it is described as "RequestFunc"), e.g. to validate body and headers together
+	RequestFunc(validation func(r *IncomingRequest) error) RequestExpectation
+
+	// AnyOf expects a given request to satisfy at least one of the given alternatives
+	// each alternative declares its validations on a separate RequestExpectation (e.g. alt.Path("/v1/users"))
+	// validations within an alternative must all match, the alternatives themselves are combined with OR
+	AnyOf(alternatives ...func(alt RequestExpectation)) RequestExpectation
+
+	// LikeRequest expects a given request to resemble the example request in the selected fields
+	// (e.g. LikeRequest(req, MatchMethod, MatchPath, MatchHeaders("X-Request-Id"), MatchBody))
+	// if no field is given, the method and the path are matched
+	// the body of the example request is read and restored, so the request can still be used afterwards
+	LikeRequest(req *http.Request, fields ...MatchField) RequestExpectation
+	// FromCurl expects a given request described by a curl command (method, path, query, headers, basic auth and body)
+	// e.g. FromCurl(`curl -X POST -H 'Content-Type: application/json' -d '{"a":1}' http://localhost/api`)
+	// a command that cannot be parsed fails the test (see FromCurl)
+	FromCurl(cmd string) RequestExpectation
 
 	// Response returns the given status code and switches to response expectation mode
 	// where you can specify the response body and headers
 	Response(code int) ResponseExpectation
+	// OK returns status code 200 and switches to response expectation mode (same as Response(http.StatusOK))
+	OK() ResponseExpectation
+	// Created returns status code 201 and switches to response expectation mode (same as Response(http.StatusCreated))
+	Created() ResponseExpectation
+	// NoContent returns status code 204 and switches to response expectation mode (same as Response(http.StatusNoContent))
+	NoContent() ResponseExpectation
+	// BadRequest returns status code 400 and switches to response expectation mode (same as Response(http.StatusBadRequest))
+	BadRequest() ResponseExpectation
+	// NotFound returns status code 404 and switches to response expectation mode (same as Response(http.StatusNotFound))
+	NotFound() ResponseExpectation
+	// InternalServerError returns status code 500 and switches to response expectation mode (same as Response(http.StatusInternalServerError))
+	InternalServerError() ResponseExpectation
+	// OnCall returns a CallExpectation to specify the response of the n-th matching call (starting at 1)
+	// all other calls fall back to the response given by Response()
+	OnCall(n int) CallExpectation
+	// RawResponse returns a copy of the given http.Response (status code, headers and body) on each matching call
+	// the body is read completely and closed immediately (e.g. to replay a captured response)
+	RawResponse(resp *http.Response) ResponseExpectation
+	// ResponseFunc computes the response of each matching call from the incoming request
+	// (e.g. to echo path parameters or capture groups of StringBodyMatches, see IncomingRequest)
+	// it cannot be combined with Response, Then or OnCall, defining both fails the test
+	// a panic of the function fails the test (t.Errorf with the request details) and is answered with 500 Internal Server Error
+	ResponseFunc(fn func(in *IncomingRequest) *MockResponse) Expectation
+	// Switch selects the response of each matching call by the value of the given request header
+	// e.g. Switch("X-Scenario").Case("slow", slowResp).Case("error", errorResp).Default(okResp)
+	// it is based on ResponseFunc, so it cannot be combined with Response or OnCall either
+	Switch(headerName string) SwitchExpectation
+	// RespondByAccept selects the response of each matching call by content negotiation with the Accept header of the request
+	// e.g. {"application/json": jsonResp, "application/xml": xmlResp}, the Content-Type is set to the selected media type if missing
+	// the response of "*/*" is used if no other media type is acceptable, otherwise the request is answered with 406 Not Acceptable
+	// it is based on ResponseFunc, so it cannot be combined with Response or OnCall either
+	RespondByAccept(responses map[string]*MockResponse) Expectation
+	// DropConnection resets the connection of each matching call instead of writing a response (TCP RST)
+	// e.g. to test that a client surfaces the error and only retries idempotent requests
+	// the call counts like a normal match, so set Times before
+	DropConnection() Expectation
+	// CloseWithoutResponse closes the connection of each matching call cleanly after reading the request
+	// without writing a response (TCP FIN), the call counts like a normal match, so set Times before
+	CloseWithoutResponse() Expectation
+	// NoResponse reads the request of each matching call but does not write a response within hangFor,
+	// then the connection is closed (e.g. to test context deadlines and http.Client timeouts)
+	// the hang ends early if the client cancels the request or the server is shut down
+	// the call counts like a normal match, so set Times before
+	NoResponse(hangFor time.Duration) Expectation
+	// RawBytes writes the given bytes verbatim to the connection of each matching call instead of a response
+	// and closes the connection (e.g. garbage, a body-only HTTP/0.9 response or a malformed status line)
+	// net/http is bypassed completely, so the connection cannot be kept alive, the call counts like a normal match
+	RawBytes(data []byte) Expectation
+}
+
+// Expectation references an expectation created by EXPECT(), it is implemented by RequestExpectation and ResponseExpectation
+// (see RequestExpectation.After)
+type Expectation interface {
+	// Done returns a channel that is closed once the expectation reached its minimum number of calls
+	// (e.g. to wait for asynchronous requests with select instead of sleeping)
+	Done() <-chan struct{}
+	// Matched returns a channel that receives each request matched by the expectation after the first call of Matched
+	// the channel is buffered, requests are dropped if the buffer is full, so matching is never blocked
+	Matched() <-chan *IncomingRequest
+	// Wait blocks until the expectation reached its minimum number of calls or the timeout elapses
+	// on timeout an error containing the number of calls is returned
+	Wait(timeout time.Duration) error
+	// Count returns the number of calls matched by the expectation so far
+	Count() int
+	// Satisfied reports if the number of calls is within the expected range (see Times, MinTimes, MaxTimes)
+	Satisfied() bool
+	// Requests returns the requests matched by the expectation so far (in order of arrival)
+	Requests() []*IncomingRequest
+	// Delays returns the response delays applied to the calls matched by the expectation so far (in order of arrival)
+	// including Opts.ResponseDelay, e.g. to check the random delays of DelayBetween
+	Delays() []time.Duration
+	// Cycles returns the number of times all responses of a cycling response sequence were used (see ResponseExpectation.Cycle)
+	Cycles() int
+
+	expectation() *requestExpectation
+}
+
+// matchedBufferSize is the number of matched requests buffered by the channel returned by Expectation.Matched
+const matchedBufferSize = 100
+
+// CallExpectation is used to specify the response of a specific call of an expectation (see RequestExpectation.OnCall)
+type CallExpectation interface {
+	// Response returns the given status code on the specific call and switches to response expectation mode
+	// where you can specify the response body and headers
+	Response(code int) ResponseExpectation
+}
+
+type callExpectation struct {
+	exp *requestExpectation
+	n   int
+}
+
+func (c *callExpectation) Response(code int) ResponseExpectation {
+	c.exp.t.Helper()
+	if err := validStatusCode(code); err != nil {
+		c.exp.t.Fatalf("response expectation failed: %v", err)
+		return nil
+	}
+	return c.exp.newResponse(code, c.n)
 }
 
 type requestExpectation struct {
-	t                  T
+	t T
+	// mu is the handler lock of the mock server, it guards modifications while requests are matched
+	mu *sync.Mutex
+	// owner is the scope that registered the expectation (nil for the mock server itself)
+	owner *scopedServer
+	// prettyJSON indents the bodies set by JsonBody (see Opts.PrettyJSON)
+	prettyJSON bool
+	// sniffContentType detects the content type of the bodies set by Body (see Opts.SniffContentType)
+	sniffContentType bool
+	// defaultContentType is set if the content type of all responses is set by Opts.DefaultResponseHeaders
+	defaultContentType bool
+	// register adds a clone to the expectations of the same kind, the handler lock must be held (see Clone)
+	// it is nil for AnyOf alternatives
+	register func(clone *requestExpectation)
+	// group is the ordered group the expectation belongs to (nil if the expectation is order-independent)
+	group              *orderedGroup
 	count              int
+	priority           int
 	min                int
 	max                int
 	requestValidations []*requestValidation
 	response           *MockResponse
-	every              bool
-	defaultExp         bool
+	callResponses      map[int]*MockResponse
+	// sequence contains the responses of consecutive calls defined by ResponseExpectation.Then (starting with response)
+	sequence []*MockResponse
+	// cycle repeats the response sequence in order instead of repeating its last response (see ResponseExpectation.Cycle)
+	cycle        bool
+	responseFunc func(in *IncomingRequest) *MockResponse
+	every        bool
+	defaultExp   bool
+	never        bool
+	// alternative is set for expectations that only collect validations for AnyOf
+	alternative bool
+	// after contains the expectations that must be satisfied before this expectation matches
+	after []*requestExpectation
+	// disabled expectations are skipped while matching (see MockServer.Disable)
+	disabled bool
+	// done is closed once the expectation reached its minimum number of calls (created by Done)
+	done chan struct{}
+	// matched receives the matched requests (created by Matched)
+	matched chan *IncomingRequest
+	// requests contains all requests matched by the expectation
+	requests []*IncomingRequest
+	// delays contains the response delays applied to the matched requests
+	delays []time.Duration
+	// pathPrefix is prepended to all paths of the expectation (see MockServer.Route)
+	pathPrefix string
+	// strict rejects requests with headers that are not in expectedHeaders (see Strict)
+	strict bool
+	// expectedHeaders contains the canonical names of the headers checked by the validations of the expectation
+	expectedHeaders []string
+	// strictViolation describes the last request rejected by strict matching (reported by AssertExpectations)
+	strictViolation string
+	// responseHooks are called after each response of the expectation was written (see ResponseExpectation.OnResponse)
+	responseHooks []ResponseHook
 }
 
 func (exp *requestExpectation) Times(n int) RequestExpectation {
+	defer exp.lock()()
 	exp.min = n
 	exp.max = n
 	return exp
 }
 
 func (exp *requestExpectation) MinTimes(n int) RequestExpectation {
+	defer exp.lock()()
 	exp.min = n
 	if exp.max == 1 {
 		exp.max = math.MaxInt32
@@ -192,6 +591,7 @@ func (exp *requestExpectation) MinTimes(n int) RequestExpectation {
 }
 
 func (exp *requestExpectation) MaxTimes(n int) RequestExpectation {
+	defer exp.lock()()
 	exp.max = n
 	if exp.min > exp.max {
 		exp.min = exp.max
@@ -199,7 +599,186 @@ func (exp *requestExpectation) MaxTimes(n int) RequestExpectation {
 	return exp
 }
 
+func (exp *requestExpectation) After(prerequisites ...Expectation) RequestExpectation {
+	defer exp.lock()()
+	for _, prerequisite := range prerequisites {
+		exp.after = append(exp.after, prerequisite.expectation())
+	}
+	return exp
+}
+
+func (exp *requestExpectation) expectation() *requestExpectation {
+	return exp
+}
+
+func (exp *requestExpectation) Done() <-chan struct{} {
+	defer exp.lock()()
+	if exp.done == nil {
+		exp.done = make(chan struct{})
+		exp.notifyDone()
+	}
+	return exp.done
+}
+
+func (exp *requestExpectation) Matched() <-chan *IncomingRequest {
+	defer exp.lock()()
+	if exp.matched == nil {
+		exp.matched = make(chan *IncomingRequest, matchedBufferSize)
+	}
+	return exp.matched
+}
+
+func (exp *requestExpectation) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-exp.Done():
+		return nil
+	case <-timer.C:
+		unlock := exp.lock()
+		count, min := exp.count, exp.min
+		unlock()
+		return fmt.Errorf("expectation not satisfied within %v: %d of %d calls", timeout, count, min)
+	}
+}
+
+func (exp *requestExpectation) Count() int {
+	defer exp.lock()()
+	return exp.count
+}
+
+func (exp *requestExpectation) Satisfied() bool {
+	defer exp.lock()()
+	return exp.count >= exp.min && exp.count <= exp.max
+}
+
+func (exp *requestExpectation) Requests() []*IncomingRequest {
+	defer exp.lock()()
+	requests := make([]*IncomingRequest, len(exp.requests))
+	copy(requests, exp.requests)
+	return requests
+}
+
+func (exp *requestExpectation) Delays() []time.Duration {
+	defer exp.lock()()
+	delays := make([]time.Duration, len(exp.delays))
+	copy(delays, exp.delays)
+	return delays
+}
+
+func (exp *requestExpectation) Cycles() int {
+	defer exp.lock()()
+	if !exp.cycle {
+		return 0
+	}
+	return exp.count / len(exp.sequence)
+}
+
+// recordCall counts a matched request and notifies the channels returned by Done and Matched
+// it is called while holding the handler lock and never blocks
+func (exp *requestExpectation) recordCall(in *IncomingRequest) {
+	exp.count++
+	exp.requests = append(exp.requests, in)
+	if exp.matched != nil {
+		select {
+		case exp.matched <- in:
+		default:
+		}
+	}
+	exp.notifyDone()
+}
+
+// notifyDone closes the done channel once the minimum number of calls is reached
+func (exp *requestExpectation) notifyDone() {
+	if exp.done == nil || exp.count < exp.min {
+		return
+	}
+	select {
+	case <-exp.done:
+	default:
+		close(exp.done)
+	}
+}
+
+// prerequisitesSatisfied checks if all expectations given by After reached their minimum number of calls
+func (exp *requestExpectation) prerequisitesSatisfied() bool {
+	for _, prerequisite := range exp.after {
+		if prerequisite.count < prerequisite.min {
+			return false
+		}
+	}
+	return true
+}
+
+func (exp *requestExpectation) Never() RequestExpectation {
+	defer exp.lock()()
+	exp.min = 0
+	exp.max = 0
+	exp.never = true
+	return exp
+}
+
+func (exp *requestExpectation) Priority(n int) RequestExpectation {
+	defer exp.lock()()
+	exp.priority = n
+	return exp
+}
+
+func (exp *requestExpectation) Strict() RequestExpectation {
+	defer exp.lock()()
+	exp.strict = true
+	return exp
+}
+
+func (exp *requestExpectation) Clone() RequestExpectation {
+	exp.t.Helper()
+	if exp.register == nil {
+		exp.t.Fatalf("AnyOf alternatives only declare request validations, therefore they cannot be cloned")
+		return exp
+	}
+
+	defer exp.lock()()
+	clone := &requestExpectation{
+		t:                  exp.t,
+		mu:                 exp.mu,
+		owner:              exp.owner,
+		register:           exp.register,
+		every:              exp.every,
+		defaultExp:         exp.defaultExp,
+		min:                exp.min,
+		max:                exp.max,
+		priority:           exp.priority,
+		never:              exp.never,
+		strict:             exp.strict,
+		pathPrefix:         exp.pathPrefix,
+		prettyJSON:         exp.prettyJSON,
+		sniffContentType:   exp.sniffContentType,
+		defaultContentType: exp.defaultContentType,
+		after:              append([]*requestExpectation(nil), exp.after...),
+		expectedHeaders:    append([]string(nil), exp.expectedHeaders...),
+	}
+	// the validations are copied, so validations added to the clone or the original do not affect the other one
+	clone.requestValidations = make([]*requestValidation, 0, len(exp.requestValidations))
+	for _, val := range exp.requestValidations {
+		clone.requestValidations = append(clone.requestValidations, &requestValidation{validation: val.validation, description: val.description, headOnly: val.headOnly, stream: val.stream})
+	}
+
+	// the clone is registered while holding the handler lock, so it is never matched without its validations
+	exp.register(clone)
+	return clone
+}
+
+// expectHeaders marks the given headers as checked by a validation of the expectation (see Strict)
+func (exp *requestExpectation) expectHeaders(names ...string) {
+	defer exp.lock()()
+	for _, name := range names {
+		exp.expectedHeaders = append(exp.expectedHeaders, http.CanonicalHeaderKey(name))
+	}
+}
+
 func (exp *requestExpectation) AnyTimes() RequestExpectation {
+	defer exp.lock()()
 	exp.min = 0
 	exp.max = math.MaxInt32
 	return exp
@@ -214,12 +793,14 @@ func (exp *requestExpectation) Twice() RequestExpectation {
 }
 
 func (exp *requestExpectation) AtMostOnce() RequestExpectation {
+	defer exp.lock()()
 	exp.min = 0
 	exp.max = 1
 	return exp
 }
 
 func (exp *requestExpectation) AtLeastOnce() RequestExpectation {
+	defer exp.lock()()
 	exp.min = 1
 	exp.max = math.MaxInt32
 	return exp
@@ -236,39 +817,90 @@ func (exp *requestExpectation) RequestMatches(method string, pathRegex string) R
 }
 
 func (exp *requestExpectation) Method(method string) RequestExpectation {
-	return exp.appendValidation(methodValidation(method), "Method: "+method)
+	return exp.appendHeadValidation(methodValidation(method), "Method: "+method)
+}
+
+func (exp *requestExpectation) MethodExact(method string) RequestExpectation {
+	return exp.appendHeadValidation(methodExactValidation(method), "MethodExact: "+method)
 }
 
 func (exp *requestExpectation) Path(path string) RequestExpectation {
-	return exp.appendValidation(pathValidation(path), "Path: "+path)
+	path = exp.prefixedPath(path)
+	return exp.appendHeadValidation(pathValidation(path), "Path: "+path)
 }
 
 func (exp *requestExpectation) PathMatches(regex string) RequestExpectation {
-	return exp.appendValidation(pathRegexValidation(regex), "PathMatches: "+regex)
+	exp.t.Helper()
+	regex = exp.prefixedPathRegex(regex)
+	compiled, ok := exp.compileRegex("PathMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendHeadValidation(pathRegexValidation(compiled), "PathMatches: "+regex)
+}
+
+func (exp *requestExpectation) PathParams(pattern string) RequestExpectation {
+	pattern = exp.prefixedPath(pattern)
+	return exp.appendHeadValidation(pathParamsValidation(pattern), "PathParams: "+pattern)
+}
+
+// prefixedPath prepends the path prefix of the route the expectation was created on (if any)
+func (exp *requestExpectation) prefixedPath(path string) string {
+	if exp.pathPrefix == "" {
+		return path
+	}
+	if path == "" {
+		return exp.pathPrefix
+	}
+	return exp.pathPrefix + "/" + strings.TrimPrefix(path, "/")
+}
+
+// prefixedPathRegex anchors the given regex below the path prefix of the route the expectation was created on (if any)
+// a regex starting with ^ has to match directly after the prefix, otherwise anywhere below the prefix
+func (exp *requestExpectation) prefixedPathRegex(regex string) string {
+	if exp.pathPrefix == "" {
+		return regex
+	}
+	if strings.HasPrefix(regex, "^") {
+		return "^" + regexp.QuoteMeta(exp.pathPrefix) + "(?:" + strings.TrimPrefix(regex, "^") + ")"
+	}
+	return "^" + regexp.QuoteMeta(exp.pathPrefix) + "/.*?(?:" + regex + ")"
 }
 
 func (exp *requestExpectation) GET() RequestExpectation {
-	return exp.appendValidation(methodValidation("GET"), "GET")
+	return exp.appendHeadValidation(methodValidation("GET"), "GET")
 }
 
 func (exp *requestExpectation) POST() RequestExpectation {
-	return exp.appendValidation(methodValidation("POST"), "POST")
+	return exp.appendHeadValidation(methodValidation("POST"), "POST")
 }
 
 func (exp *requestExpectation) PUT() RequestExpectation {
-	return exp.appendValidation(methodValidation("PUT"), "PUT")
+	return exp.appendHeadValidation(methodValidation("PUT"), "PUT")
 }
 
 func (exp *requestExpectation) PATCH() RequestExpectation {
-	return exp.appendValidation(methodValidation("PATCH"), "PATCH")
+	return exp.appendHeadValidation(methodValidation("PATCH"), "PATCH")
 }
 
 func (exp *requestExpectation) DELETE() RequestExpectation {
-	return exp.appendValidation(methodValidation("DELETE"), "DELETE")
+	return exp.appendHeadValidation(methodValidation("DELETE"), "DELETE")
 }
 
 func (exp *requestExpectation) HEAD() RequestExpectation {
-	return exp.appendValidation(methodValidation("HEAD"), "HEAD")
+	return exp.appendHeadValidation(methodValidation("HEAD"), "HEAD")
+}
+
+func (exp *requestExpectation) OPTIONS() RequestExpectation {
+	return exp.appendHeadValidation(methodValidation("OPTIONS"), "OPTIONS")
+}
+
+func (exp *requestExpectation) TRACE() RequestExpectation {
+	return exp.appendHeadValidation(methodValidation("TRACE"), "TRACE")
+}
+
+func (exp *requestExpectation) CONNECT() RequestExpectation {
+	return exp.appendHeadValidation(methodValidation("CONNECT"), "CONNECT")
 }
 
 func (exp *requestExpectation) Get(path string) RequestExpectation {
@@ -319,16 +951,83 @@ func (exp *requestExpectation) HeadMatches(regex string) RequestExpectation {
 	return exp.RequestMatches("HEAD", regex)
 }
 
+func (exp *requestExpectation) Options(path string) RequestExpectation {
+	return exp.Request("OPTIONS", path)
+}
+
+func (exp *requestExpectation) OptionsMatches(regex string) RequestExpectation {
+	return exp.RequestMatches("OPTIONS", regex)
+}
+
+func (exp *requestExpectation) Trace(path string) RequestExpectation {
+	return exp.Request("TRACE", path)
+}
+
+func (exp *requestExpectation) TraceMatches(regex string) RequestExpectation {
+	return exp.RequestMatches("TRACE", regex)
+}
+
+func (exp *requestExpectation) Connect(path string) RequestExpectation {
+	return exp.Request("CONNECT", path)
+}
+
+func (exp *requestExpectation) ConnectMatches(regex string) RequestExpectation {
+	return exp.RequestMatches("CONNECT", regex)
+}
+
 func (exp *requestExpectation) Header(name, value string) RequestExpectation {
-	return exp.appendValidation(headerValidation(name, value), "Header: "+name+":"+value)
+	exp.expectHeaders(name)
+	return exp.appendHeadValidation(headerValidation(name, value), "Header: "+name+":"+value)
+}
+
+func (exp *requestExpectation) Trailer(name, value string) RequestExpectation {
+	return exp.appendValidation(trailerValidation(name, value), "Trailer: "+name+":"+value)
 }
 
 func (exp *requestExpectation) HeaderExists(name string) RequestExpectation {
-	return exp.appendValidation(headerExistsValidation(name), "HeaderExists: "+name)
+	exp.expectHeaders(name)
+	return exp.appendHeadValidation(headerExistsValidation(name), "HeaderExists: "+name)
 }
 
 func (exp *requestExpectation) HeaderMatches(name, regex string) RequestExpectation {
-	return exp.appendValidation(headerMatchesValidation(name, regex), "HeaderMatches: "+name+":"+regex)
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("HeaderMatches", regex)
+	if !ok {
+		return exp
+	}
+	exp.expectHeaders(name)
+	return exp.appendHeadValidation(headerMatchesValidation(name, compiled), "HeaderMatches: "+name+":"+regex)
+}
+
+func (exp *requestExpectation) HeaderFold(name, value string) RequestExpectation {
+	exp.expectHeaders(name)
+	return exp.appendHeadValidation(headerFoldValidation(name, value), "HeaderFold: "+name+":"+value)
+}
+
+func (exp *requestExpectation) Accepts(mediaType string) RequestExpectation {
+	exp.expectHeaders("Accept")
+	return exp.appendHeadValidation(acceptsValidation(mediaType), "Accepts: "+mediaType)
+}
+
+func (exp *requestExpectation) CORSPreflight(origin string) RequestExpectation {
+	exp.OPTIONS()
+	exp.Header("Origin", origin)
+	return exp.HeaderExists("Access-Control-Request-Method")
+}
+
+func (exp *requestExpectation) Referer(value string) RequestExpectation {
+	exp.expectHeaders("Referer", "Referrer")
+	return exp.appendHeadValidation(refererValidation(value), "Referer: "+value)
+}
+
+func (exp *requestExpectation) RefererMatches(regex string) RequestExpectation {
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("RefererMatches", regex)
+	if !ok {
+		return exp
+	}
+	exp.expectHeaders("Referer", "Referrer")
+	return exp.appendHeadValidation(refererMatchesValidation(compiled), "RefererMatches: "+regex)
 }
 
 func (exp *requestExpectation) Headers(headers map[string]string) RequestExpectation {
@@ -338,6 +1037,33 @@ func (exp *requestExpectation) Headers(headers map[string]string) RequestExpecta
 	return exp
 }
 
+func (exp *requestExpectation) HeadersExactly(headers map[string]string) RequestExpectation {
+	exp.Headers(headers)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+	return exp.appendHeadValidation(headersExactlyValidation(names), "HeadersExactly: "+strings.Join(names, ", "))
+}
+
+func (exp *requestExpectation) TLS() RequestExpectation {
+	return exp.appendHeadValidation(tlsValidation(), "TLS")
+}
+
+func (exp *requestExpectation) TLSMinVersion(version uint16) RequestExpectation {
+	return exp.appendHeadValidation(tlsMinVersionValidation(version), "TLSMinVersion: "+tlsVersionName(version))
+}
+
+func (exp *requestExpectation) RemoteAddr(ip string) RequestExpectation {
+	return exp.appendHeadValidation(remoteAddrValidation(ip), "RemoteAddr: "+ip)
+}
+
+func (exp *requestExpectation) ForwardedFor(ip string) RequestExpectation {
+	exp.expectHeaders("X-Forwarded-For")
+	return exp.appendHeadValidation(forwardedForValidation(ip), "ForwardedFor: "+ip)
+}
+
 func (exp *requestExpectation) FormParameter(name, value string) RequestExpectation {
 	return exp.appendValidation(formParameterValidation(name, value), "FormParameter: "+name+":"+value)
 }
@@ -347,7 +1073,12 @@ func (exp *requestExpectation) FormParameterExists(name string) RequestExpectati
 }
 
 func (exp *requestExpectation) FormParameterMatches(name string, regex string) RequestExpectation {
-	return exp.appendValidation(formParameterMatchesValidation(name, regex), "FormParameterMatches: "+name+":"+regex)
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("FormParameterMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendValidation(formParameterMatchesValidation(name, compiled), "FormParameterMatches: "+name+":"+regex)
 }
 
 func (exp *requestExpectation) FormParameters(formParameters map[string]string) RequestExpectation {
@@ -357,16 +1088,25 @@ func (exp *requestExpectation) FormParameters(formParameters map[string]string)
 	return exp
 }
 
+func (exp *requestExpectation) FormParameterValues(name string, values []string) RequestExpectation {
+	return exp.appendValidation(formParameterValuesValidation(name, values), "FormParameterValues: "+name+":"+strings.Join(values, ","))
+}
+
 func (exp *requestExpectation) QueryParameter(name, value string) RequestExpectation {
-	return exp.appendValidation(queryParameterValidation(name, value), "QueryParameter: "+name+":"+value)
+	return exp.appendHeadValidation(queryParameterValidation(name, value), "QueryParameter: "+name+":"+value)
 }
 
 func (exp *requestExpectation) QueryParameterExists(name string) RequestExpectation {
-	return exp.appendValidation(queryParameterExistsValidation(name), "QueryParameterExists: "+name)
+	return exp.appendHeadValidation(queryParameterExistsValidation(name), "QueryParameterExists: "+name)
 }
 
 func (exp *requestExpectation) QueryParameterMatches(name string, regex string) RequestExpectation {
-	return exp.appendValidation(queryParameterMatchesValidation(name, regex), "QueryParameterMatches: "+name+":"+regex)
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("QueryParameterMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendHeadValidation(queryParameterMatchesValidation(name, compiled), "QueryParameterMatches: "+name+":"+regex)
 }
 
 func (exp *requestExpectation) QueryParameters(queryParameters map[string]string) RequestExpectation {
@@ -376,32 +1116,123 @@ func (exp *requestExpectation) QueryParameters(queryParameters map[string]string
 	return exp
 }
 
+func (exp *requestExpectation) RawQuery(expected string) RequestExpectation {
+	return exp.appendHeadValidation(rawQueryValidation(expected), "RawQuery: "+expected)
+}
+
+func (exp *requestExpectation) RawQueryMatches(regex string) RequestExpectation {
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("RawQueryMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendHeadValidation(rawQueryMatchesValidation(compiled), "RawQueryMatches: "+regex)
+}
+
+func (exp *requestExpectation) QueryParametersExactly(queryParameters map[string]string) RequestExpectation {
+	exp.QueryParameters(queryParameters)
+	keys := make([]string, 0, len(queryParameters))
+	for key := range queryParameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return exp.appendHeadValidation(queryParametersExactlyValidation(keys), "QueryParametersExactly: "+strings.Join(keys, ", "))
+}
+
 func (exp *requestExpectation) BasicAuth(user, password string) RequestExpectation {
-	return exp.appendValidation(basicAuthValidation(user, password), "Basic auth: "+user+":"+password)
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(basicAuthValidation(user, password), "Basic auth: "+user+":"+password)
 }
 
 func (exp *requestExpectation) BasicAuthExists() RequestExpectation {
-	return exp.appendValidation(basicAuthExistsValidation(), "Basic auth exists")
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(basicAuthExistsValidation(), "Basic auth exists")
+}
+
+func (exp *requestExpectation) OAuth2ClientCredentials(clientID, clientSecret string) RequestExpectation {
+	exp.POST()
+	exp.FormParameter("grant_type", "client_credentials")
+	exp.expectHeaders("Authorization", "Content-Type")
+	return exp.appendValidation(oauth2ClientCredentialsValidation(clientID, clientSecret), "OAuth2 client credentials: "+clientID)
 }
 
 func (exp *requestExpectation) JWTTokenExists() RequestExpectation {
-	return exp.appendValidation(jwtTokenExistsValidation(), "JWT token exists")
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenExistsValidation(), "JWT token exists")
 }
 
 func (exp *requestExpectation) JWTTokenClaimPath(jsonPath string, value interface{}) RequestExpectation {
-	return exp.appendValidation(jwtTokenClaimPathValidation(jsonPath, value), "JWT token claim path: "+jsonPath)
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenClaimPathValidation(jsonPath, value), "JWT token claim path: "+jsonPath)
+}
+
+func (exp *requestExpectation) JWTTokenClaimMatches(jsonPath string, regex string) RequestExpectation {
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("JWTTokenClaimMatches", regex)
+	if !ok {
+		return exp
+	}
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenClaimMatchesValidation(jsonPath, compiled), "JWT token claim matches: "+jsonPath+":"+regex)
+}
+
+func (exp *requestExpectation) JWTTokenClaims(claims map[string]interface{}) RequestExpectation {
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenClaimsValidation(claims), "JWT token claims: "+fmt.Sprintf("%+v", claims))
+}
+
+func (exp *requestExpectation) JWTTokenNotExpired() RequestExpectation {
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenNotExpiredValidation(), "JWT token not expired")
+}
+
+func (exp *requestExpectation) JWTTokenExpiresWithin(d time.Duration) RequestExpectation {
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenExpiresWithinValidation(d), "JWT token expires within: "+d.String())
+}
+
+func (exp *requestExpectation) JWTTokenIssuedWithin(d time.Duration) RequestExpectation {
+	exp.expectHeaders("Authorization")
+	return exp.appendHeadValidation(jwtTokenIssuedWithinValidation(d), "JWT token issued within: "+d.String())
 }
 
 func (exp *requestExpectation) JSONBody(expected interface{}) RequestExpectation {
 	return exp.appendValidation(jsonBodyValidation(expected), "JSONBody: "+fmt.Sprintf("%+v", expected))
 }
 
+func (exp *requestExpectation) ExpectBody(expected interface{}) RequestExpectation {
+	exp.expectHeaders("Content-Type")
+	return exp.appendValidation(expectBodyValidation(expected), "ExpectBody: "+fmt.Sprintf("%+v", expected))
+}
+
+func (exp *requestExpectation) YAMLBody(expected interface{}) RequestExpectation {
+	return exp.appendValidation(yamlBodyValidation(expected), "YAMLBody: "+fmt.Sprintf("%+v", expected))
+}
+
+func (exp *requestExpectation) ProtoBody(msg proto.Message) RequestExpectation {
+	exp.expectHeaders("Content-Type")
+	return exp.appendValidation(protoBodyValidation(msg), "ProtoBody: "+prototext.Format(msg))
+}
+
 func (exp *requestExpectation) JSONPathContains(jsonPath string, value interface{}) RequestExpectation {
 	return exp.appendValidation(jsonPathContainsValidation(jsonPath, value), "JSONPathContains: "+jsonPath)
 }
 
+func (exp *requestExpectation) JSONBodyContains(expected interface{}) RequestExpectation {
+	return exp.appendValidation(jsonBodyContainsValidation(expected), "JSONBodyContains: "+fmt.Sprintf("%+v", expected))
+}
+
+func (exp *requestExpectation) StrictJSONBodyContains(expected interface{}) RequestExpectation {
+	return exp.appendValidation(strictJSONBodyContainsValidation(expected), "StrictJSONBodyContains: "+fmt.Sprintf("%+v", expected))
+}
+
 func (exp *requestExpectation) JSONPathMatches(jsonPath string, regex string) RequestExpectation {
-	return exp.appendValidation(jsonPathMatchesValidation(jsonPath, regex), "JSONPathMatches: "+jsonPath)
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("JSONPathMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendValidation(jsonPathMatchesValidation(jsonPath, compiled), "JSONPathMatches: "+jsonPath)
 }
 
 func (exp *requestExpectation) StringBody(body string) RequestExpectation {
@@ -413,48 +1244,548 @@ func (exp *requestExpectation) StringBodyContains(substring string) RequestExpec
 }
 
 func (exp *requestExpectation) StringBodyMatches(regex string) RequestExpectation {
-	return exp.appendValidation(stringBodyMatchValidation(regex), "StringBodyMatches: "+regex)
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("StringBodyMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendValidation(stringBodyMatchValidation(compiled), "StringBodyMatches: "+regex)
+}
+
+func (exp *requestExpectation) BodyMatches(regex string) RequestExpectation {
+	exp.t.Helper()
+	compiled, ok := exp.compileRegex("BodyMatches", regex)
+	if !ok {
+		return exp
+	}
+	return exp.appendValidation(bodyMatchesValidation(compiled), "BodyMatches: "+regex)
 }
 
 func (exp *requestExpectation) Body(body []byte) RequestExpectation {
 	return exp.appendValidation(bodyValidation(body), "Body: "+string(body))
 }
 
+func (exp *requestExpectation) BodyLength(n int) RequestExpectation {
+	return exp.appendValidation(bodyLengthValidation(n, n), fmt.Sprintf("BodyLength: %d", n))
+}
+
+func (exp *requestExpectation) BodyLengthBetween(min, max int) RequestExpectation {
+	exp.t.Helper()
+	if min > max {
+		exp.t.Fatalf("invalid body length range: min %d is greater than max %d", min, max)
+		return exp
+	}
+	return exp.appendValidation(bodyLengthValidation(min, max), fmt.Sprintf("BodyLengthBetween: %d-%d", min, max))
+}
+
+func (exp *requestExpectation) MultipartFieldCount(n int) RequestExpectation {
+	return exp.appendValidation(multipartCountValidation(n, false), fmt.Sprintf("MultipartFieldCount: %d", n))
+}
+
+func (exp *requestExpectation) MultipartFileCount(n int) RequestExpectation {
+	return exp.appendValidation(multipartCountValidation(n, true), fmt.Sprintf("MultipartFileCount: %d", n))
+}
+
+func (exp *requestExpectation) ContentLengthMatchesBody() RequestExpectation {
+	return exp.appendValidation(contentLengthMatchesBodyValidation(), "ContentLengthMatchesBody")
+}
+
 func (exp *requestExpectation) BodyFunc(bodyValidation func(body []byte) error) RequestExpectation {
 	return exp.appendValidation(bodyFuncValidation(bodyValidation), "BodyFunc")
 }
 
+func (exp *requestExpectation) BodyStreamFunc(bodyValidation func(body io.Reader) error) RequestExpectation {
+	defer exp.lock()()
+	exp.requestValidations = append(exp.requestValidations, &requestValidation{
+		validation:  bodyStreamFuncValidation(bodyValidation),
+		description: "BodyStreamFunc",
+		headOnly:    true,
+		stream:      true,
+	})
+	return exp
+}
+
 func (exp *requestExpectation) Custom(validation RequestValidationFunc, description string) RequestExpectation {
 	return exp.appendValidation(validation, description)
 }
 
+func (exp *requestExpectation) RequestFunc(validation func(r *IncomingRequest) error) RequestExpectation {
+	return exp.appendValidation(validation, "RequestFunc")
+}
+
+func (exp *requestExpectation) AnyOf(alternatives ...func(alt RequestExpectation)) RequestExpectation {
+	exp.t.Helper()
+	if len(alternatives) == 0 {
+		exp.t.Fatalf("AnyOf requires at least one alternative")
+		return exp
+	}
+
+	branches := make([][]*requestValidation, 0, len(alternatives))
+	descriptions := make([]string, 0, len(alternatives))
+	for i, alternative := range alternatives {
+		alt := &requestExpectation{t: exp.t, alternative: true, pathPrefix: exp.pathPrefix}
+		alternative(alt)
+		if len(alt.requestValidations) == 0 {
+			exp.t.Fatalf("AnyOf alternative %d has no request validation specified", i+1)
+			return exp
+		}
+
+		branchDescriptions := make([]string, 0, len(alt.requestValidations))
+		for _, val := range alt.requestValidations {
+			branchDescriptions = append(branchDescriptions, val.description)
+		}
+
+		branches = append(branches, alt.requestValidations)
+		exp.expectHeaders(alt.expectedHeaders...)
+		descriptions = append(descriptions, "("+strings.Join(branchDescriptions, " AND ")+")")
+	}
+
+	validation := anyOfValidation(branches)
+	description := "AnyOf: " + strings.Join(descriptions, " OR ")
+	for _, branch := range branches {
+		for _, val := range branch {
+			if !val.headOnly {
+				return exp.appendValidation(validation, description)
+			}
+		}
+	}
+	return exp.appendHeadValidation(validation, description)
+}
+
+func (exp *requestExpectation) LikeRequest(req *http.Request, fields ...MatchField) RequestExpectation {
+	exp.t.Helper()
+	if req == nil {
+		exp.t.Fatalf("LikeRequest requires an example request")
+		return exp
+	}
+	if len(fields) == 0 {
+		fields = []MatchField{MatchMethod, MatchPath}
+	}
+
+	exp.likeRequest(req, fields)
+	return exp
+}
+
+func (exp *requestExpectation) FromCurl(cmd string) RequestExpectation {
+	exp.t.Helper()
+	spec, err := FromCurl(cmd)
+	if err != nil {
+		exp.t.Fatalf("FromCurl: %v", err)
+		return exp
+	}
+
+	spec.apply(exp)
+	return exp
+}
+
 func (exp *requestExpectation) Response(code int) ResponseExpectation {
+	exp.t.Helper()
+	if err := validStatusCode(code); err != nil {
+		exp.t.Fatalf("response expectation failed: %v", err)
+		return nil
+	}
+	return exp.newResponse(code, 0)
+}
+
+func (exp *requestExpectation) OK() ResponseExpectation {
+	exp.t.Helper()
+	return exp.Response(http.StatusOK)
+}
+
+func (exp *requestExpectation) Created() ResponseExpectation {
+	exp.t.Helper()
+	return exp.Response(http.StatusCreated)
+}
+
+func (exp *requestExpectation) NoContent() ResponseExpectation {
+	exp.t.Helper()
+	return exp.Response(http.StatusNoContent)
+}
+
+func (exp *requestExpectation) BadRequest() ResponseExpectation {
+	exp.t.Helper()
+	return exp.Response(http.StatusBadRequest)
+}
+
+func (exp *requestExpectation) NotFound() ResponseExpectation {
+	exp.t.Helper()
+	return exp.Response(http.StatusNotFound)
+}
+
+func (exp *requestExpectation) InternalServerError() ResponseExpectation {
+	exp.t.Helper()
+	return exp.Response(http.StatusInternalServerError)
+}
+
+func (exp *requestExpectation) RawResponse(raw *http.Response) ResponseExpectation {
+	exp.t.Helper()
+	var body []byte
+	if raw.Body != nil {
+		var err error
+		body, err = io.ReadAll(raw.Body)
+		_ = raw.Body.Close()
+		if err != nil {
+			exp.t.Fatalf("response expectation failed: could not read body of raw response: %v", err)
+			return nil
+		}
+	}
+
+	if err := validStatusCode(raw.StatusCode); err != nil {
+		exp.t.Fatalf("response expectation failed: %v", err)
+		return nil
+	}
+	response := exp.newResponse(raw.StatusCode, 0)
+	if response == nil {
+		return nil
+	}
+
+	resp := response.(*responseExpectation)
+	defer resp.lock()()
+	resp.resp.HeaderValues = raw.Header.Clone()
+	resp.resp.Body = body
+	return resp
+}
+
+func (exp *requestExpectation) OnCall(n int) CallExpectation {
+	exp.t.Helper()
+	if n < 1 {
+		exp.t.Fatalf("OnCall expects a call number of at least 1 but was %d", n)
+	}
+	return &callExpectation{exp: exp, n: n}
+}
+
+func (exp *requestExpectation) ResponseFunc(fn func(in *IncomingRequest) *MockResponse) Expectation {
+	exp.t.Helper()
+	if !exp.canRespond() {
+		return exp
+	}
+
+	unlock := exp.lock()
+	// the response func would silently replace the responses defined before (or be replaced by them)
+	if exp.response != nil || len(exp.sequence) > 0 || len(exp.callResponses) > 0 {
+		unlock()
+		exp.t.Fatalf("response expectation failed: response is already defined, ResponseFunc cannot be combined with Response, Then or OnCall")
+		return exp
+	}
+	exp.responseFunc = fn
+	unlock()
+	return exp
+}
+
+func (exp *requestExpectation) DropConnection() Expectation {
+	exp.t.Helper()
+	return exp.newFault(ResetConnection)
+}
+
+func (exp *requestExpectation) CloseWithoutResponse() Expectation {
+	exp.t.Helper()
+	return exp.newFault(CloseConnection)
+}
+
+func (exp *requestExpectation) NoResponse(hangFor time.Duration) Expectation {
+	exp.t.Helper()
+	if hangFor < 0 {
+		exp.t.Fatalf("response expectation failed: hang duration must not be negative: %v", hangFor)
+		return nil
+	}
+
+	fault := exp.newFault(CloseConnection)
+	if fault == nil {
+		return nil
+	}
+
+	resp := fault.(*responseExpectation)
+	defer resp.lock()()
+	resp.resp.Hang = hangFor
+	return resp
+}
+
+func (exp *requestExpectation) RawBytes(data []byte) Expectation {
+	exp.t.Helper()
+	fault := exp.newFault(CloseConnection)
+	if fault == nil {
+		return nil
+	}
+
+	resp := fault.(*responseExpectation)
+	defer resp.lock()()
+	resp.resp.Raw = append([]byte{}, data...)
+	return resp
+}
+
+// newFault creates a response of the expectation that closes the connection instead of being written
+func (exp *requestExpectation) newFault(fault ConnectionFault) Expectation {
+	exp.t.Helper()
+	response := exp.newResponse(0, 0)
+	if response == nil {
+		return nil
+	}
+
+	resp := response.(*responseExpectation)
+	defer resp.lock()()
+	resp.resp.Fault = fault
+	return resp
+}
+
+func (exp *requestExpectation) Switch(headerName string) SwitchExpectation {
+	exp.t.Helper()
+	sw := &switchExpectation{
+		Expectation: exp,
+		exp:         exp,
+		header:      headerName,
+		cases:       make(map[string]*MockResponse),
+	}
+	exp.ResponseFunc(sw.response)
+	return sw
+}
+
+func (exp *requestExpectation) RespondByAccept(responses map[string]*MockResponse) Expectation {
+	exp.t.Helper()
+	// the responses are copied, so the map of the caller may be reused
+	byMediaType := make(map[string]*MockResponse, len(responses))
+	offers := make([]string, 0, len(responses))
+	for mediaType, resp := range responses {
+		byMediaType[mediaType] = resp
+		if resp == nil {
+			exp.t.Fatalf("response expectation failed: response of media type %v must not be nil", mediaType)
+			return exp
+		}
+		if !strings.Contains(mediaType, "/") {
+			exp.t.Fatalf("response expectation failed: invalid media type %v", mediaType)
+			return exp
+		}
+		if err := validMockResponse(resp); err != nil {
+			exp.t.Fatalf("response expectation failed: response of media type %v: %v", mediaType, err)
+			return exp
+		}
+		if mediaType != "*/*" {
+			offers = append(offers, mediaType)
+		}
+	}
+
+	exp.ResponseFunc(func(in *IncomingRequest) *MockResponse {
+		mediaType := negotiateMediaType(in.R.Header.Values("Accept"), offers)
+		if mediaType == "" {
+			if fallback, ok := byMediaType["*/*"]; ok {
+				return fallback
+			}
+			return &MockResponse{Code: http.StatusNotAcceptable}
+		}
+
+		resp := byMediaType[mediaType].copy()
+		if _, ok := resp.Headers["Content-Type"]; !ok {
+			resp.Headers["Content-Type"] = mediaType
+		}
+		return resp
+	})
+	return exp
+}
+
+// canRespond checks if a response may be defined on the expectation and fails the test otherwise
+func (exp *requestExpectation) canRespond() bool {
 	exp.t.Helper()
 	if exp.every {
 		exp.t.Fatalf("Every is used to check conditions on every request, therefore it cannot be used with Response()")
-		return nil
+		return false
+	}
+
+	if exp.alternative {
+		exp.t.Fatalf("AnyOf alternatives only declare request validations, therefore they cannot be used with Response()")
+		return false
 	}
 
 	if len(exp.requestValidations) == 0 && !exp.defaultExp {
 		exp.t.Fatalf("no request validation specified")
 	}
+	return true
+}
+
+// validStatusCode checks that the code can be written as status code of a final response
+func validStatusCode(code int) error {
+	if code >= 100 && code <= 199 {
+		return fmt.Errorf("informational status code %d cannot be the final response, use Informational to write it before the response", code)
+	}
+	if code < 200 || code > 599 {
+		return fmt.Errorf("invalid status code %d, expected 200-599", code)
+	}
+	return nil
+}
+
+// validMockResponse checks the status code of a response given as MockResponse (e.g. by RespondByAccept)
+// a response closing the connection is not written and therefore needs no status code
+func validMockResponse(resp *MockResponse) error {
+	if resp.Fault != NoFault {
+		return nil
+	}
+	return validStatusCode(resp.Code)
+}
+
+// newResponse creates the response of the expectation
+// call is the matching call the response is used for (0 for the response of all calls without a specific one)
+func (exp *requestExpectation) newResponse(code int, call int) ResponseExpectation {
+	exp.t.Helper()
+	if !exp.canRespond() {
+		return nil
+	}
 
-	exp.response = &MockResponse{
+	resp := &MockResponse{
 		Code:    code,
 		Headers: make(map[string]string),
 	}
 
-	responseExpectation := &responseExpectation{
+	unlock := exp.lock()
+	// a second response would silently replace the first one, while the first response expectation is still modifiable
+	if _, ok := exp.callResponses[call]; exp.responseFunc != nil || (call == 0 && exp.response != nil) || (call != 0 && ok) {
+		unlock()
+		if exp.responseFunc != nil {
+			exp.t.Fatalf("response expectation failed: response is already defined by ResponseFunc, it cannot be combined with Response, Then or OnCall")
+		} else if call == 0 {
+			exp.t.Fatalf("response expectation failed: response is already defined, use Then for a sequence of responses or OnCall for the response of a specific call")
+		} else {
+			exp.t.Fatalf("response expectation failed: response of call %d is already defined", call)
+		}
+		return nil
+	}
+	if call == 0 {
+		exp.response = resp
+		exp.sequence = nil
+		exp.cycle = false
+	} else {
+		if exp.callResponses == nil {
+			exp.callResponses = make(map[int]*MockResponse)
+		}
+		exp.callResponses[call] = resp
+	}
+	unlock()
+
+	return &responseExpectation{
+		t:    exp.t,
+		resp: resp,
+		exp:  exp,
+		call: call,
+	}
+}
+
+// cycleSequence makes the response sequence repeat in order (see ResponseExpectation.Cycle)
+func (exp *requestExpectation) cycleSequence() {
+	defer exp.lock()()
+	if len(exp.sequence) == 0 {
+		exp.sequence = []*MockResponse{exp.response}
+	}
+	exp.cycle = true
+}
+
+// appendSequence adds a response for the next call to the response sequence of the expectation (see ResponseExpectation.Then)
+func (exp *requestExpectation) appendSequence(code int) ResponseExpectation {
+	resp := &MockResponse{
+		Code:    code,
+		Headers: make(map[string]string),
+	}
+
+	defer exp.lock()()
+	if len(exp.sequence) == 0 {
+		exp.sequence = []*MockResponse{exp.response}
+	}
+	exp.sequence = append(exp.sequence, resp)
+
+	return &responseExpectation{
 		t:    exp.t,
-		resp: exp.response,
+		resp: resp,
+		exp:  exp,
 	}
+}
 
-	responseExpectation.resp.Code = code
+// responseFor returns the response for the given matching call
+// a call specific response takes precedence over the response of all calls
+// nil is returned if the response is computed by the response func
+func (exp *requestExpectation) responseFor(call int) *MockResponse {
+	if resp, ok := exp.callResponses[call]; ok {
+		return resp
+	}
+	if len(exp.sequence) > 0 {
+		if exp.cycle {
+			return exp.sequence[(call-1)%len(exp.sequence)]
+		}
+		// calls beyond the sequence repeat the last response (see Opts.StrictResponseSequences)
+		if call <= len(exp.sequence) {
+			return exp.sequence[call-1]
+		}
+		return exp.sequence[len(exp.sequence)-1]
+	}
+	if exp.responseFunc != nil {
+		// the response is computed by the caller without holding the handler lock
+		return nil
+	}
+	return exp.response
+}
 
-	return responseExpectation
+// callResponseFunc computes the response by the response func of the expectation
+// a panic of the response func fails the test and is answered with 500 Internal Server Error
+func (exp *requestExpectation) callResponseFunc(fn func(in *IncomingRequest) *MockResponse, in *IncomingRequest) (resp *MockResponse) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			exp.t.Errorf("ResponseFunc panicked: %v\nMethod: %v\nPath: %v\nHeaders: %v\nBody: %v", recovered, in.R.Method, in.R.URL.Path, in.R.Header, bodyString(in))
+			resp = &MockResponse{
+				Code: http.StatusInternalServerError,
+				Body: []byte(fmt.Sprintf("ResponseFunc panicked: %v", recovered)),
+			}
+		}
+	}()
+	return fn(in)
 }
 
 func (exp *requestExpectation) appendValidation(validation RequestValidationFunc, description string) *requestExpectation {
-	exp.requestValidations = append(exp.requestValidations, &requestValidation{validation, description, false})
+	defer exp.lock()()
+	exp.requestValidations = append(exp.requestValidations, &requestValidation{validation: validation, description: description})
+	return exp
+}
+
+// appendHeadValidation appends a validation that only inspects the request line and headers
+// and therefore does not need the request body to be read (see Opts.LazyBody)
+func (exp *requestExpectation) appendHeadValidation(validation RequestValidationFunc, description string) *requestExpectation {
+	defer exp.lock()()
+	exp.requestValidations = append(exp.requestValidations, &requestValidation{validation: validation, description: description, headOnly: true})
 	return exp
 }
+
+// needsBody reports whether matching or answering a request by this expectation requires the buffered request body
+func (exp *requestExpectation) needsBody() bool {
+	if exp.responseFunc != nil {
+		return true
+	}
+	for _, val := range exp.requestValidations {
+		if !val.headOnly {
+			return true
+		}
+	}
+	responses := append([]*MockResponse{exp.response}, exp.sequence...)
+	for _, resp := range exp.callResponses {
+		responses = append(responses, resp)
+	}
+	for _, resp := range responses {
+		if resp != nil && resp.templates != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRegex compiles the regex of the given matcher once at build time and fails the test on an invalid pattern
+func (exp *requestExpectation) compileRegex(matcher string, regex string) (*regexp.Regexp, bool) {
+	exp.t.Helper()
+	compiled, err := regexp.Compile(regex)
+	if err != nil {
+		exp.t.Fatalf("invalid regex for %v %v: %v", matcher, regex, err)
+		return nil, false
+	}
+	return compiled, true
+}
+
+// lock acquires the handler lock of the mock server (if any) and returns the corresponding unlock function
+func (exp *requestExpectation) lock() func() {
+	if exp.mu == nil {
+		return func() {}
+	}
+	exp.mu.Lock()
+	return exp.mu.Unlock
+}
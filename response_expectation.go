@@ -1,101 +1,772 @@
 package httpmockserver
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
 )
 
 type MockResponse struct {
 	Code    int
 	Headers map[string]string
-	Body    []byte
+	// HeaderValues are written after Headers and may contain multiple values per key (e.g. Set-Cookie)
+	HeaderValues http.Header
+	// Trailers are declared by the Trailer header and sent after the body, the body is chunked then
+	Trailers map[string]string
+	Body     []byte
+	// EchoHeaders are copied with all their values from the request into the response (see ResponseExpectation.EchoRequestHeader)
+	// a header missing in the request is set to the value returned by its generator, it is omitted if the generator is nil
+	EchoHeaders map[string]func() string
+	// NoContentType suppresses the Content-Type header, so it is not sniffed from the body by net/http (see ResponseExpectation.ContentType)
+	// a Content-Type given by Headers or HeaderValues is written nevertheless
+	NoContentType bool
+	// Interim are informational (1xx) responses written before the response (see ResponseExpectation.Informational)
+	Interim []InterimResponse
+	// BodyReader returns a reader for each call that is streamed as body instead of Body (see ResponseExpectation.BodyFromReaderFunc)
+	// the reader is closed after it was streamed if it implements io.Closer
+	BodyReader func() io.Reader
+	// Chunks are streamed instead of Body with chunked transfer encoding, each chunk is flushed
+	// and ChunkInterval is waited between the chunks (see ResponseExpectation.StreamBody)
+	Chunks        [][]byte
+	ChunkInterval time.Duration
+	// TruncateStream closes the connection after the last chunk without terminating the chunked body
+	TruncateStream bool
+	// Stall writes only the first StallAfter bytes of the body and then keeps the connection open
+	// until the request is cancelled or the server is shut down
+	Stall      bool
+	StallAfter int
+	// Delay delays the response by the given duration (added to Opts.ResponseDelay)
+	Delay time.Duration
+	// Jitter adds a random delay between 0 and Jitter drawn from Opts.Rand to Delay (see ResponseExpectation.DelayBetween)
+	Jitter time.Duration
+	// DelayFunc returns the delay of each response, it replaces Delay and Jitter if set (see ResponseExpectation.DelayDistribution)
+	DelayFunc func() time.Duration
+	// Fault closes the connection instead of writing the response (see RequestExpectation.DropConnection)
+	Fault ConnectionFault
+	// Hang waits for the given duration before the connection is closed by Fault (see RequestExpectation.NoResponse)
+	Hang time.Duration
+	// Raw is written verbatim to the connection before it is closed by Fault (see RequestExpectation.RawBytes)
+	Raw []byte
+	// FailRate is the fraction of calls answered with FailCode instead of this response, drawn from Opts.Rand (see ResponseExpectation.Flaky)
+	FailRate float64
+	FailCode int
+	// HTTP10 writes the response as HTTP/1.0 with a Content-Length and closes the connection afterwards
+	HTTP10 bool
+	// TruncateBody announces the Content-Length of the complete body, but only writes the first TruncateAfter bytes
+	// and closes the connection afterwards (see ResponseExpectation.TruncateBodyAfter)
+	TruncateBody  bool
+	TruncateAfter int
+	// OverrideContentLength announces ContentLength instead of the length of the body and closes the connection
+	// after the body (see ResponseExpectation.OverrideContentLength)
+	OverrideContentLength bool
+	ContentLength         int64
+
+	// templates are rendered into Body and Headers for each matching call (see ResponseExpectation.TemplateBody)
+	templates *responseTemplates
+	// served describes the expectation that produced the response for the OnResponse hooks, it is set for each matching call
+	served *servedResponse
+	// scope is the scope of the expectation that produced the response (nil for the mock server itself, see LastResponse)
+	scope *scopedServer
+}
+
+// InterimResponse is an informational (1xx) response written before the final response, e.g. 103 Early Hints
+type InterimResponse struct {
+	Code    int
+	Headers map[string]string
+}
+
+// ConnectionFault describes how the connection is closed instead of writing a response
+type ConnectionFault int
+
+const (
+	// NoFault writes the response as usual
+	NoFault ConnectionFault = iota
+	// ResetConnection resets the connection without writing a response (TCP RST)
+	ResetConnection
+	// CloseConnection closes the connection cleanly without writing a response (TCP FIN)
+	CloseConnection
+)
+
+// copy returns a copy of the response that can be written without holding the handler lock
+func (resp *MockResponse) copy() *MockResponse {
+	c := *resp
+	c.Headers = make(map[string]string, len(resp.Headers))
+	for key, value := range resp.Headers {
+		c.Headers[key] = value
+	}
+	c.HeaderValues = resp.HeaderValues.Clone()
+	if resp.Trailers != nil {
+		c.Trailers = make(map[string]string, len(resp.Trailers))
+		for key, value := range resp.Trailers {
+			c.Trailers[key] = value
+		}
+	}
+	if resp.EchoHeaders != nil {
+		c.EchoHeaders = make(map[string]func() string, len(resp.EchoHeaders))
+		for key, generate := range resp.EchoHeaders {
+			c.EchoHeaders[key] = generate
+		}
+	}
+	if resp.Interim != nil {
+		c.Interim = make([]InterimResponse, 0, len(resp.Interim))
+		for _, interim := range resp.Interim {
+			headers := make(map[string]string, len(interim.Headers))
+			for key, value := range interim.Headers {
+				headers[key] = value
+			}
+			c.Interim = append(c.Interim, InterimResponse{Code: interim.Code, Headers: headers})
+		}
+	}
+	return &c
+}
+
+// echo copies the headers given by EchoHeaders from the request into the response, it is called on a copy of the response
+func (resp *MockResponse) echo(in *IncomingRequest) {
+	if len(resp.EchoHeaders) == 0 {
+		return
+	}
+
+	if resp.HeaderValues == nil {
+		resp.HeaderValues = make(http.Header, len(resp.EchoHeaders))
+	}
+	for key, generate := range resp.EchoHeaders {
+		if values := in.R.Header.Values(key); len(values) > 0 {
+			resp.HeaderValues[key] = append([]string(nil), values...)
+		} else if generate != nil {
+			resp.HeaderValues.Set(key, generate())
+		}
+	}
+}
+
+// body returns the reader of the response body and its size (-1 if the size is unknown)
+func (resp *MockResponse) body() (io.Reader, int64) {
+	if resp.Chunks != nil {
+		readers := make([]io.Reader, 0, len(resp.Chunks))
+		for _, chunk := range resp.Chunks {
+			readers = append(readers, bytes.NewReader(chunk))
+		}
+		return io.MultiReader(readers...), -1
+	}
+	if resp.BodyReader == nil {
+		return bytes.NewReader(resp.Body), int64(len(resp.Body))
+	}
+
+	r := resp.BodyReader()
+	switch t := r.(type) {
+	case nil:
+		return bytes.NewReader(nil), 0
+	case *bytes.Reader:
+		return r, int64(t.Len())
+	case *strings.Reader:
+		return r, int64(t.Len())
+	case *os.File:
+		info, err := t.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return r, -1
+		}
+		offset, err := t.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return r, -1
+		}
+		return r, info.Size() - offset
+	}
+	return r, -1
 }
 
 // ResponseExpectation is a builder for a MockResponse
 // you may set Headers, Body, and Code on the response
 // this response is returned to the caller when the corresponding request is matched
 type ResponseExpectation interface {
+	Expectation
+
 	ContentType(contentType string) ResponseExpectation
+	RawContentType(value string) ResponseExpectation
+	CORS(allowOrigin string, methods []string) ResponseExpectation
 	Header(key, value string) ResponseExpectation
 	Headers(headers map[string]string) ResponseExpectation
+	// Trailer sets a trailer that is sent after the body (e.g. grpc-status or a checksum), the body is chunked then
+	Trailer(key, value string) ResponseExpectation
+	// Informational writes an informational (1xx) response with the given headers before the response
+	// (e.g. 103 Early Hints with Link headers), it may be called multiple times, the responses are written in order
+	// 101 Switching Protocols is not supported, the in-process transport skips informational responses
+	Informational(code int, headers map[string]string) ResponseExpectation
 	StringBody(body string) ResponseExpectation
 	JsonBody(object interface{}) ResponseExpectation
+	// JsonBodyIndent sets the body to the indented json encoding of the object (e.g. JsonBodyIndent(user, "", "  "))
+	// map keys are sorted, struct fields keep their declaration order (see json.MarshalIndent)
+	JsonBodyIndent(object interface{}, prefix, indent string) ResponseExpectation
 	Body(data []byte) ResponseExpectation
+	// BodyFromReader streams the body from the given reader instead of buffering it (e.g. for multi-megabyte responses)
+	// Content-Length is set for a *bytes.Reader, *strings.Reader or *os.File, otherwise the body is chunked
+	// the reader can only be streamed once, use BodyFromReaderFunc for expectations matched more than once
+	BodyFromReader(r io.Reader) ResponseExpectation
+	// BodyFromReaderFunc streams the body from a new reader returned by the func for each call
+	BodyFromReaderFunc(newReader func() io.Reader) ResponseExpectation
+	// StreamBody streams the chunks with chunked transfer encoding, each chunk is flushed and the interval is waited between the chunks
+	// e.g. to test clients that process streamed responses incrementally (progress bars, incremental json decoders)
+	StreamBody(chunks [][]byte, interval time.Duration) ResponseExpectation
+	// TruncateStream closes the connection after the last chunk of StreamBody without terminating the chunked body
+	// e.g. to test the handling of truncated streams
+	TruncateStream() ResponseExpectation
+	WriteThenStall(n int) ResponseExpectation
+	// TruncateBodyAfter announces the Content-Length of the complete body, but closes the connection after the first n bytes
+	// e.g. to test the handling of truncated downloads, the request counts towards Times as usual
+	TruncateBodyAfter(n int) ResponseExpectation
+	// OverrideContentLength announces the given Content-Length regardless of the body, a larger value than the body
+	// makes the client wait for missing bytes until the connection is closed, a smaller one makes it drop the surplus bytes
+	OverrideContentLength(n int64) ResponseExpectation
+	Delay(d time.Duration) ResponseExpectation
+	DelayBetween(min, max time.Duration) ResponseExpectation
+	DelayDistribution(delay func() time.Duration) ResponseExpectation
+	OAuth2TokenResponse(accessToken string, expiresIn time.Duration) ResponseExpectation
+	// Then defines the response of the next call (e.g. Response(503).Then(200) answers the first call with 503, the second with 200)
+	// calls beyond the sequence repeat the last response unless Opts.StrictResponseSequences is set
+	// AssertExpectations fails if not all responses of the sequence were used
+	Then(code int) ResponseExpectation
+	// Cycle repeats the responses of the sequence in order indefinitely instead of repeating the last one
+	// (e.g. Response(200).Then(503).Cycle() with AnyTimes for an alternating health check)
+	Cycle() ResponseExpectation
+	// Flaky answers a random fraction of the calls (0 to 1, drawn from Opts.Rand) with the given status code instead of the response
+	// e.g. Flaky(0.3, 503) to exercise retries, the calls count towards Times regardless of the outcome
+	Flaky(failRate float64, failCode int) ResponseExpectation
+	// TemplateBody sets the body to a text/template rendered with the request of each matching call (see TemplateContext)
+	// e.g. `{"id": "{{ .PathParam "id" }}", "name": {{ .JSONPath "$.name" | printf "%q" }}}`
+	// a template that cannot be parsed fails the test, an execution error fails the test when the request is matched
+	TemplateBody(tmpl string) ResponseExpectation
+	// TemplateHeader sets a header to a text/template rendered with the request of each matching call (see TemplateContext)
+	TemplateHeader(key, tmpl string) ResponseExpectation
+	// EchoRequestHeader copies the given headers with all their values from the matched request into the response
+	// (e.g. X-Request-Id or traceparent), a header missing in the request is omitted
+	EchoRequestHeader(names ...string) ResponseExpectation
+	// EchoRequestHeaderOr copies the given header like EchoRequestHeader, but sets it to the value returned by generate
+	// if it is missing in the request (e.g. to create a request id), generate is called before the response is written
+	// without holding the handler lock, so it may be called concurrently and may use the mock server
+	EchoRequestHeaderOr(name string, generate func() string) ResponseExpectation
+	// HTTP10 writes the response as HTTP/1.0 (no chunking, the connection is closed afterwards)
+	// e.g. to test the compatibility of clients with legacy servers
+	HTTP10() ResponseExpectation
+	// OnResponse registers a hook that is called after each response of the expectation was written (e.g. to log or
+	// assert on rendered template bodies), it is called before the hooks registered by MockServer.OnResponse
+	// the hook receives a copy of the response, a panic of the hook fails the test (t.Errorf with the request details)
+	OnResponse(hook ResponseHook) ResponseExpectation
 }
 
 type responseExpectation struct {
 	resp *MockResponse
 	t    T
+	// exp is the request expectation the response belongs to
+	exp *requestExpectation
+	// call is the matching call the response is used for (0 for the response of all calls, see OnCall)
+	call int
+}
+
+func (exp *responseExpectation) expectation() *requestExpectation {
+	return exp.exp
+}
+
+// Done returns a channel that is closed once the expectation reached its minimum number of calls
+func (exp *responseExpectation) Done() <-chan struct{} {
+	return exp.exp.Done()
+}
+
+// Matched returns a channel that receives each request matched by the expectation after the first call of Matched
+func (exp *responseExpectation) Matched() <-chan *IncomingRequest {
+	return exp.exp.Matched()
+}
+
+// Wait blocks until the expectation reached its minimum number of calls or the timeout elapses
+func (exp *responseExpectation) Wait(timeout time.Duration) error {
+	return exp.exp.Wait(timeout)
+}
+
+// Count returns the number of calls matched by the expectation so far
+func (exp *responseExpectation) Count() int {
+	return exp.exp.Count()
+}
+
+// Satisfied reports if the number of calls is within the expected range
+func (exp *responseExpectation) Satisfied() bool {
+	return exp.exp.Satisfied()
+}
+
+// Requests returns the requests matched by the expectation so far (in order of arrival)
+func (exp *responseExpectation) Requests() []*IncomingRequest {
+	return exp.exp.Requests()
+}
+
+// Delays returns the response delays applied to the calls matched by the expectation so far (in order of arrival)
+func (exp *responseExpectation) Delays() []time.Duration {
+	return exp.exp.Delays()
+}
+
+// lock acquires the handler lock of the mock server, so the response is not modified while it is written
+func (exp *responseExpectation) lock() func() {
+	return exp.exp.lock()
 }
 
 // ContentType sets the content type header on the response
+// an empty content type suppresses the header, it is neither set by the body setters nor sniffed by net/http
 func (exp *responseExpectation) ContentType(contentType string) ResponseExpectation {
+	defer exp.lock()()
+	if contentType == "" {
+		delete(exp.resp.Headers, "Content-Type")
+		exp.resp.NoContentType = true
+		return exp
+	}
 	exp.resp.Headers["Content-Type"] = contentType
+	exp.resp.NoContentType = false
+	return exp
+}
+
+// hasContentType reports whether the content type of the response is set, suppressed or set by Opts.DefaultResponseHeaders
+// the handler lock must be held
+func (exp *responseExpectation) hasContentType() bool {
+	_, ok := exp.resp.Headers["Content-Type"]
+	return ok || exp.resp.NoContentType || exp.exp.defaultContentType
+}
+
+// RawContentType sets the content type header on the response to the given value without any validation or normalization
+// use it to test how clients handle malformed content types (e.g. "application/json; charset=")
+func (exp *responseExpectation) RawContentType(value string) ResponseExpectation {
+	defer exp.lock()()
+	exp.resp.Headers["Content-Type"] = value
+	return exp
+}
+
+// CORS sets the standard CORS headers on the response (e.g. "https://example.com", []string{"GET", "POST"})
+// Access-Control-Allow-Headers is set to "*", use Header to restrict it
+func (exp *responseExpectation) CORS(allowOrigin string, methods []string) ResponseExpectation {
+	defer exp.lock()()
+	exp.resp.Headers["Access-Control-Allow-Origin"] = allowOrigin
+	exp.resp.Headers["Access-Control-Allow-Methods"] = strings.Join(methods, ", ")
+	exp.resp.Headers["Access-Control-Allow-Headers"] = "*"
 	return exp
 }
 
 // Header sets a header on the response
 func (exp *responseExpectation) Header(key, value string) ResponseExpectation {
-	exp.resp.Headers[key] = value
+	defer exp.lock()()
+	exp.resp.Headers[http.CanonicalHeaderKey(key)] = value
 	return exp
 }
 
 // Headers sets multiple headers on the response
 func (exp *responseExpectation) Headers(headers map[string]string) ResponseExpectation {
+	defer exp.lock()()
+	for key, value := range headers {
+		exp.resp.Headers[http.CanonicalHeaderKey(key)] = value
+	}
+	return exp
+}
+
+// Trailer sets a trailer of the response, the trailer is declared by the Trailer header and its value is sent after the body
+func (exp *responseExpectation) Trailer(key, value string) ResponseExpectation {
+	defer exp.lock()()
+	if exp.resp.Trailers == nil {
+		exp.resp.Trailers = make(map[string]string)
+	}
+	exp.resp.Trailers[http.CanonicalHeaderKey(key)] = value
+	return exp
+}
+
+func (exp *responseExpectation) Informational(code int, headers map[string]string) ResponseExpectation {
+	exp.t.Helper()
+	if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+		exp.t.Fatalf("response expectation failed: invalid informational status code %d, expected 100-199 (except 101)", code)
+		return exp
+	}
+
+	defer exp.lock()()
+	interim := InterimResponse{Code: code, Headers: make(map[string]string, len(headers))}
 	for key, value := range headers {
-		exp.resp.Headers[key] = value
+		interim.Headers[key] = value
 	}
+	exp.resp.Interim = append(exp.resp.Interim, interim)
 	return exp
 }
 
 // StringBody sets the body of the response to the given string (e.g. "Hello World" or `{"foo":"bar"}`)
+// automatically sets the content type to text/plain; charset=utf-8 if ContentType is not set yet (or by Opts.DefaultResponseHeaders)
 func (exp *responseExpectation) StringBody(body string) ResponseExpectation {
+	unlock := exp.lock()
+	if !exp.hasContentType() {
+		exp.resp.Headers["Content-Type"] = "text/plain; charset=utf-8"
+	}
+	unlock()
+
 	return exp.Body([]byte(body))
 }
 
 // JsonBody sets the body of the response to the given object (e.g. `{"foo":"bar"}` or map[string]string{"foo":"bar"})
-// you may provide a go object or a valid json string
+// you may provide a go object or already encoded json (string, []byte or json.RawMessage), which is written verbatim
+// already encoded json is validated, an invalid json fails the test
 // automatically sets the content type to application/json if ContentType is not set yet
 func (exp *responseExpectation) JsonBody(object interface{}) ResponseExpectation {
 	exp.t.Helper()
+	if exp.exp.prettyJSON {
+		return exp.jsonBody(object, "", "  ", false)
+	}
+	return exp.jsonBody(object, "", "", false)
+}
+
+// JsonBodyIndent sets the body of the response to the indented json encoding of the given object (see json.MarshalIndent)
+// already encoded json is indented as well
+func (exp *responseExpectation) JsonBodyIndent(object interface{}, prefix, indent string) ResponseExpectation {
+	exp.t.Helper()
+	return exp.jsonBody(object, prefix, indent, true)
+}
+
+// jsonBody sets the body of the response to the json encoding of the object, indented if prefix or indent is given
+// already encoded json is written verbatim unless reindent is set
+func (exp *responseExpectation) jsonBody(object interface{}, prefix, indent string, reindent bool) ResponseExpectation {
+	exp.t.Helper()
 
 	// check if ContentType is set, if not set it to application/json
-	if _, ok := exp.resp.Headers["Content-Type"]; !ok {
+	unlock := exp.lock()
+	if !exp.hasContentType() {
 		exp.resp.Headers["Content-Type"] = "application/json"
 	}
+	unlock()
 
 	if object == nil {
 		return exp.Body(nil)
 	}
 
+	var encoded []byte
 	switch t := object.(type) {
+	case json.RawMessage:
+		encoded = t
 	case []byte:
-		var object interface{}
-		err := json.Unmarshal(t, &object)
-		if err != nil {
-			exp.t.Fatalf("response expectation failed: could not parse to json: %+v", object)
-		}
-		resData, _ := json.Marshal(object)
-		return exp.Body(resData)
+		encoded = t
 	case string:
-		var object interface{}
-		err := json.Unmarshal([]byte(t), &object)
-		if err != nil {
-			exp.t.Fatalf("response expectation failed: could not parse to json: %+v", object)
+		encoded = []byte(t)
+	}
+	if encoded != nil {
+		if !json.Valid(encoded) {
+			exp.t.Fatalf("response expectation failed: could not parse to json: %s", encoded)
+			return exp
 		}
-		resData, _ := json.Marshal(object)
-		return exp.Body(resData)
+		if !reindent {
+			return exp.Body(encoded)
+		}
+
+		var buf bytes.Buffer
+		_ = json.Indent(&buf, encoded, prefix, indent)
+		return exp.Body(buf.Bytes())
 	}
 
-	jsonBody, err := json.Marshal(object)
+	// map keys are sorted by encoding/json, struct fields keep their declaration order
+	var jsonBody []byte
+	var err error
+	if prefix == "" && indent == "" {
+		jsonBody, err = json.Marshal(object)
+	} else {
+		jsonBody, err = json.MarshalIndent(object, prefix, indent)
+	}
 	if err != nil {
 		exp.t.Fatalf("response expectation failed: could not parse to json: %+v", object)
+		return exp
 	}
 
 	return exp.Body(jsonBody)
 }
 
 // Body sets the body of the response to the given byte array (e.g. []byte("Hello World") or []byte(`{"foo":"bar"}`))
+// with Opts.SniffContentType the content type is detected from the body if ContentType is not set yet
 func (exp *responseExpectation) Body(data []byte) ResponseExpectation {
+	defer exp.lock()()
+	if exp.exp.sniffContentType && len(data) > 0 && !exp.hasContentType() {
+		exp.resp.Headers["Content-Type"] = http.DetectContentType(data)
+	}
 	exp.resp.Body = data
+	exp.resp.BodyReader = nil
+	exp.resp.Chunks = nil
+	if exp.resp.templates != nil {
+		exp.resp.templates.body = nil
+	}
+	return exp
+}
+
+// BodyFromReader streams the body of the response from the given reader
+func (exp *responseExpectation) BodyFromReader(r io.Reader) ResponseExpectation {
+	exp.t.Helper()
+	if r == nil {
+		exp.t.Fatalf("response expectation failed: body reader must not be nil")
+		return exp
+	}
+
+	return exp.BodyFromReaderFunc(func() io.Reader { return r })
+}
+
+// BodyFromReaderFunc streams the body of the response from a new reader for each call
+func (exp *responseExpectation) BodyFromReaderFunc(newReader func() io.Reader) ResponseExpectation {
+	exp.t.Helper()
+	if newReader == nil {
+		exp.t.Fatalf("response expectation failed: body reader func must not be nil")
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.Body = nil
+	exp.resp.BodyReader = newReader
+	exp.resp.Chunks = nil
+	if exp.resp.templates != nil {
+		exp.resp.templates.body = nil
+	}
+	return exp
+}
+
+// StreamBody streams the body of the response in the given chunks
+func (exp *responseExpectation) StreamBody(chunks [][]byte, interval time.Duration) ResponseExpectation {
+	exp.t.Helper()
+	if interval < 0 {
+		exp.t.Fatalf("response expectation failed: chunk interval must not be negative: %v", interval)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.Body = nil
+	exp.resp.BodyReader = nil
+	exp.resp.Chunks = append([][]byte{}, chunks...)
+	exp.resp.ChunkInterval = interval
+	if exp.resp.templates != nil {
+		exp.resp.templates.body = nil
+	}
+	return exp
+}
+
+// TruncateStream ends the streamed body of the response by closing the connection
+func (exp *responseExpectation) TruncateStream() ResponseExpectation {
+	exp.t.Helper()
+	defer exp.lock()()
+	if exp.resp.Chunks == nil {
+		exp.t.Fatalf("response expectation failed: TruncateStream requires StreamBody")
+		return exp
+	}
+
+	exp.resp.TruncateStream = true
+	return exp
+}
+
+// WriteThenStall writes only the first n bytes of the body, flushes them and then blocks without closing the connection
+// until the client cancels the request or the server is shut down (e.g. to test client read timeouts)
+func (exp *responseExpectation) WriteThenStall(n int) ResponseExpectation {
+	exp.t.Helper()
+	if n < 0 {
+		exp.t.Fatalf("response expectation failed: number of bytes to write must not be negative: %v", n)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.Stall = true
+	exp.resp.StallAfter = n
+	return exp
+}
+
+// TruncateBodyAfter closes the connection after the first n bytes of the body, although the complete body was announced
+func (exp *responseExpectation) TruncateBodyAfter(n int) ResponseExpectation {
+	exp.t.Helper()
+	if n < 0 {
+		exp.t.Fatalf("response expectation failed: number of bytes to write must not be negative: %v", n)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.TruncateBody = true
+	exp.resp.TruncateAfter = n
+	return exp
+}
+
+// OverrideContentLength announces the given Content-Length instead of the length of the body
+func (exp *responseExpectation) OverrideContentLength(n int64) ResponseExpectation {
+	exp.t.Helper()
+	if n < 0 {
+		exp.t.Fatalf("response expectation failed: content length must not be negative: %v", n)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.OverrideContentLength = true
+	exp.resp.ContentLength = n
+	return exp
+}
+
+// Delay delays the response by the given duration, the delay is aborted if the request is cancelled
+// a server-wide Opts.ResponseDelay is added to this delay
+func (exp *responseExpectation) Delay(d time.Duration) ResponseExpectation {
+	defer exp.lock()()
+	exp.resp.Delay = d
+	exp.resp.Jitter = 0
+	exp.resp.DelayFunc = nil
+	return exp
+}
+
+// DelayBetween delays each response by a random duration between min and max (inclusive) drawn from Opts.Rand
+// like Delay, the delay is aborted if the request is cancelled and Opts.ResponseDelay is added
+func (exp *responseExpectation) DelayBetween(min, max time.Duration) ResponseExpectation {
+	exp.t.Helper()
+	if min < 0 || max < min {
+		exp.t.Fatalf("response expectation failed: invalid delay range: %v - %v", min, max)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.Delay = min
+	exp.resp.Jitter = max - min
+	exp.resp.DelayFunc = nil
+	return exp
+}
+
+// DelayDistribution delays each response by the duration returned by delay (e.g. to sample from a custom latency distribution)
+// delay is called while matching the request and must not block, negative durations are treated as 0
+// use a seeded random source in delay to reproduce the delays of a test run
+func (exp *responseExpectation) DelayDistribution(delay func() time.Duration) ResponseExpectation {
+	exp.t.Helper()
+	if delay == nil {
+		exp.t.Fatalf("response expectation failed: delay distribution must not be nil")
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.Delay = 0
+	exp.resp.Jitter = 0
+	exp.resp.DelayFunc = delay
+	return exp
+}
+
+// Then defines the response of the next call of the expectation and switches to it
+func (exp *responseExpectation) Then(code int) ResponseExpectation {
+	exp.t.Helper()
+	if exp.call != 0 {
+		exp.t.Fatalf("response expectation failed: Then cannot be used with OnCall, the call of the response is already given")
+		return exp
+	}
+	if err := validStatusCode(code); err != nil {
+		exp.t.Fatalf("response expectation failed: %v", err)
+		return exp
+	}
+	return exp.exp.appendSequence(code)
+}
+
+// Cycle repeats the response sequence of the expectation in order indefinitely
+func (exp *responseExpectation) Cycle() ResponseExpectation {
+	exp.t.Helper()
+	if exp.call != 0 {
+		exp.t.Fatalf("response expectation failed: Cycle cannot be used with OnCall, the call of the response is already given")
+		return exp
+	}
+	exp.exp.cycleSequence()
+	return exp
+}
+
+func (exp *responseExpectation) OnResponse(hook ResponseHook) ResponseExpectation {
+	defer exp.lock()()
+	// the hooks are copied on write, so running hooks are not affected by hooks registered concurrently
+	exp.exp.responseHooks = append(append([]ResponseHook{}, exp.exp.responseHooks...), hook)
+	return exp
+}
+
+// Cycles returns the number of times all responses of a cycling response sequence were used
+func (exp *responseExpectation) Cycles() int {
+	return exp.exp.Cycles()
+}
+
+// Flaky answers a random fraction of the calls with the given status code instead of the response
+func (exp *responseExpectation) Flaky(failRate float64, failCode int) ResponseExpectation {
+	exp.t.Helper()
+	if failRate < 0 || failRate > 1 {
+		exp.t.Fatalf("response expectation failed: fail rate must be between 0 and 1: %v", failRate)
+		return exp
+	}
+	if err := validStatusCode(failCode); err != nil {
+		exp.t.Fatalf("response expectation failed: %v", err)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.resp.FailRate = failRate
+	exp.resp.FailCode = failCode
+	return exp
+}
+
+// TemplateBody sets the body of the response to a template rendered for each matching call
+func (exp *responseExpectation) TemplateBody(tmpl string) ResponseExpectation {
+	exp.t.Helper()
+	parsed, err := template.New("body").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		exp.t.Fatalf("response expectation failed: could not parse body template: %v", err)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.templates().body = parsed
+	exp.resp.BodyReader = nil
+	exp.resp.Chunks = nil
 	return exp
 }
+
+// TemplateHeader sets a header of the response to a template rendered for each matching call
+func (exp *responseExpectation) TemplateHeader(key, tmpl string) ResponseExpectation {
+	exp.t.Helper()
+	parsed, err := template.New(key).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		exp.t.Fatalf("response expectation failed: could not parse template of header %v: %v", key, err)
+		return exp
+	}
+
+	defer exp.lock()()
+	exp.templates().headers[http.CanonicalHeaderKey(key)] = parsed
+	return exp
+}
+
+// templates returns the templates of the response, the handler lock must be held by the caller
+func (exp *responseExpectation) templates() *responseTemplates {
+	if exp.resp.templates == nil {
+		exp.resp.templates = &responseTemplates{headers: make(map[string]*template.Template)}
+	}
+	return exp.resp.templates
+}
+
+func (exp *responseExpectation) EchoRequestHeader(names ...string) ResponseExpectation {
+	defer exp.lock()()
+	for _, name := range names {
+		exp.echoHeader(name, nil)
+	}
+	return exp
+}
+
+func (exp *responseExpectation) EchoRequestHeaderOr(name string, generate func() string) ResponseExpectation {
+	defer exp.lock()()
+	exp.echoHeader(name, generate)
+	return exp
+}
+
+// echoHeader adds the header to the headers copied from the request, the handler lock must be held by the caller
+func (exp *responseExpectation) echoHeader(name string, generate func() string) {
+	if exp.resp.EchoHeaders == nil {
+		exp.resp.EchoHeaders = make(map[string]func() string)
+	}
+	exp.resp.EchoHeaders[http.CanonicalHeaderKey(name)] = generate
+}
+
+// HTTP10 writes the response as HTTP/1.0 on the hijacked connection
+func (exp *responseExpectation) HTTP10() ResponseExpectation {
+	defer exp.lock()()
+	exp.resp.HTTP10 = true
+	return exp
+}
+
+// OAuth2TokenResponse sets the body of the response to a standard OAuth2 token response (RFC 6749 section 5.1)
+// e.g. {"access_token":"abc","expires_in":3600,"token_type":"Bearer"}
+func (exp *responseExpectation) OAuth2TokenResponse(accessToken string, expiresIn time.Duration) ResponseExpectation {
+	return exp.JsonBody(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(expiresIn / time.Second),
+	})
+}
@@ -0,0 +1,60 @@
+package httpmockserver
+
+import "strings"
+
+// Route is used to create expectations for requests below a shared path prefix (see MockServer.Route)
+// all path based helpers (e.g. Path, Get, PathMatches, PathParams) of its expectations are relative to the prefix
+type Route interface {
+	// EVERY returns a RequestExpectation that will match on any call (see MockServer.EVERY)
+	EVERY() RequestExpectation
+	// EXPECT returns a RequestExpectation with paths relative to the prefix of the route (see MockServer.EXPECT)
+	EXPECT() RequestExpectation
+	// DEFAULT returns a RequestExpectation with paths relative to the prefix of the route (see MockServer.DEFAULT)
+	DEFAULT() RequestExpectation
+	// Route returns a nested route, its prefix is appended to the prefix of this route (e.g. /api + /v2 = /api/v2)
+	Route(prefix string) Route
+}
+
+type route struct {
+	server *mockServer
+	t      T
+	// owner is the scope that created the route (nil for the mock server itself)
+	owner  *scopedServer
+	prefix string
+}
+
+func newRoute(server *mockServer, t T, owner *scopedServer, prefix string) *route {
+	return &route{server: server, t: t, owner: owner, prefix: joinPathPrefix("", prefix)}
+}
+
+func (rt *route) EVERY() RequestExpectation {
+	return rt.withPrefix(rt.server.registerEvery(rt.t, rt.owner))
+}
+
+func (rt *route) EXPECT() RequestExpectation {
+	return rt.withPrefix(rt.server.registerExpectation(rt.t, rt.owner))
+}
+
+func (rt *route) DEFAULT() RequestExpectation {
+	return rt.withPrefix(rt.server.registerDefault(rt.t, rt.owner))
+}
+
+func (rt *route) Route(prefix string) Route {
+	return &route{server: rt.server, t: rt.t, owner: rt.owner, prefix: joinPathPrefix(rt.prefix, prefix)}
+}
+
+func (rt *route) withPrefix(exp RequestExpectation) RequestExpectation {
+	reqExp := exp.(*requestExpectation)
+	defer reqExp.lock()()
+	reqExp.pathPrefix = rt.prefix
+	return reqExp
+}
+
+// joinPathPrefix appends prefix to parent, the result starts with a slash and has no trailing slash (e.g. /api/v2)
+func joinPathPrefix(parent, prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return parent
+	}
+	return parent + "/" + prefix
+}
@@ -0,0 +1,110 @@
+package httpmockserver
+
+import "time"
+
+// scopedServer is a view on a mock server with its own T and its own set of expectations
+// it shares the underlying http server (and therefore BaseURL) with the mock server
+// the captured requests and the last response are limited to the ones matched by the expectations of the scope
+type scopedServer struct {
+	*mockServer
+	t            T
+	assertCalled bool
+	// lastResponse is the response written for the most recent request matched by the scope, it is guarded by the handler lock
+	lastResponse *MockResponse
+}
+
+func (sc *scopedServer) EVERY() RequestExpectation {
+	return sc.mockServer.registerEvery(sc.t, sc)
+}
+
+func (sc *scopedServer) EXPECT() RequestExpectation {
+	return sc.mockServer.registerExpectation(sc.t, sc)
+}
+
+func (sc *scopedServer) NthRequest(n int) RequestExpectation {
+	return sc.mockServer.registerNthRequest(sc.t, sc, n)
+}
+
+func (sc *scopedServer) DEFAULT() RequestExpectation {
+	return sc.mockServer.registerDefault(sc.t, sc)
+}
+
+func (sc *scopedServer) Route(prefix string) Route {
+	return newRoute(sc.mockServer, sc.t, sc, prefix)
+}
+
+func (sc *scopedServer) InOrder() OrderedGroup {
+	return &orderedGroup{server: sc.mockServer, t: sc.t, owner: sc}
+}
+
+func (sc *scopedServer) Scoped(t T) MockServer {
+	return sc.mockServer.Scoped(t)
+}
+
+// AssertExpectations checks only the expectations of the scope and removes them (including EVERY and DEFAULT expectations)
+func (sc *scopedServer) AssertExpectations() {
+	sc.t.Helper()
+	sc.assertCalled = true
+	sc.mockServer.assertExpectations(sc.t, sc)
+}
+
+// Shutdown does not stop the shared mock server, it only checks that AssertExpectations was called on the scope
+func (sc *scopedServer) Shutdown() {
+	if !sc.assertCalled {
+		sc.t.Fatalf("AssertExpectations() was not called on scope, no expectations were checked")
+	}
+}
+
+// Requests returns the requests matched by the expectations of the scope
+func (sc *scopedServer) Requests() []*CapturedRequest {
+	sc.handlerMutex.Lock()
+	defer sc.handlerMutex.Unlock()
+
+	matched := sc.matchedRequests()
+	captured := make([]*CapturedRequest, 0, len(matched))
+	for _, in := range matched {
+		captured = append(captured, &CapturedRequest{t: sc.t, in: in})
+	}
+	return captured
+}
+
+// WaitForRequests waits until the expectations of the scope matched at least n requests
+func (sc *scopedServer) WaitForRequests(n int, timeout time.Duration) error {
+	return sc.mockServer.waitForRequests(n, timeout, func() int {
+		return len(sc.matchedRequests())
+	})
+}
+
+// LastRequest returns the most recent request matched by the expectations of the scope
+func (sc *scopedServer) LastRequest() *CapturedRequest {
+	sc.handlerMutex.Lock()
+	defer sc.handlerMutex.Unlock()
+
+	matched := sc.matchedRequests()
+	if len(matched) == 0 {
+		return nil
+	}
+	return &CapturedRequest{t: sc.t, in: matched[len(matched)-1]}
+}
+
+// LastResponse returns the response written for the most recent request matched by the expectations of the scope
+func (sc *scopedServer) LastResponse() *MockResponse {
+	sc.handlerMutex.Lock()
+	defer sc.handlerMutex.Unlock()
+
+	if sc.lastResponse == nil {
+		return nil
+	}
+	return sc.lastResponse.copy()
+}
+
+// matchedRequests returns the requests matched by the expectations of the scope, the handler lock must be held
+func (sc *scopedServer) matchedRequests() []*IncomingRequest {
+	var matched []*IncomingRequest
+	for _, in := range sc.requests {
+		if in.scope == sc {
+			matched = append(matched, in)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,67 @@
+package httpmockserver
+
+// SwitchExpectation selects the response of an expectation by the value of a request header (see RequestExpectation.Switch)
+type SwitchExpectation interface {
+	Expectation
+
+	// Case returns the given response if the header has the given value (e.g. "error", &MockResponse{Code: 500})
+	Case(value string, resp *MockResponse) SwitchExpectation
+	// Default returns the given response if no case matches the header value (or the header is missing)
+	// without a default, a request matching no case fails the test
+	Default(resp *MockResponse) SwitchExpectation
+}
+
+type switchExpectation struct {
+	Expectation
+
+	exp    *requestExpectation
+	header string
+	// cases and fallback are guarded by the handler lock
+	cases    map[string]*MockResponse
+	fallback *MockResponse
+}
+
+func (sw *switchExpectation) Case(value string, resp *MockResponse) SwitchExpectation {
+	sw.exp.t.Helper()
+	if !sw.valid(resp) {
+		return sw
+	}
+
+	defer sw.exp.lock()()
+	sw.cases[value] = resp
+	return sw
+}
+
+func (sw *switchExpectation) Default(resp *MockResponse) SwitchExpectation {
+	sw.exp.t.Helper()
+	if !sw.valid(resp) {
+		return sw
+	}
+
+	defer sw.exp.lock()()
+	sw.fallback = resp
+	return sw
+}
+
+// valid checks the status code of a case response and fails the test otherwise
+func (sw *switchExpectation) valid(resp *MockResponse) bool {
+	sw.exp.t.Helper()
+	if resp == nil {
+		return true
+	}
+	if err := validMockResponse(resp); err != nil {
+		sw.exp.t.Fatalf("response expectation failed: %v", err)
+		return false
+	}
+	return true
+}
+
+// response returns the response of the case matching the header value of the request, it is used as response func
+// response funcs are called without holding the handler lock, so the cases are read while holding it
+func (sw *switchExpectation) response(in *IncomingRequest) *MockResponse {
+	defer sw.exp.lock()()
+	if resp, ok := sw.cases[in.R.Header.Get(sw.header)]; ok {
+		return resp
+	}
+	return sw.fallback
+}
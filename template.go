@@ -0,0 +1,111 @@
+package httpmockserver
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/oliveagle/jsonpath"
+)
+
+// TemplateContext is passed to response templates (see ResponseExpectation.TemplateBody and TemplateHeader)
+// e.g. {"id": "{{ .PathParam "id" }}", "name": {{ .JSONPath "$.name" | printf "%q" }}, "page": "{{ .Query.page }}", "call": {{ .Count }}}
+// a missing map key (e.g. {{ .JSON.name }} or {{ .Query.page }}) fails the template, use index for optional values (e.g. {{ index .Query "page" }})
+type TemplateContext struct {
+	// Count is the number of the matching call of the expectation (starting at 1)
+	Count int
+	// Method is the method of the request
+	Method string
+	// Path is the path of the request url
+	Path string
+	// PathParams contains the named path segments (see RequestExpectation.PathParams), e.g. {{ .PathParams.id }}
+	PathParams map[string]string
+	// Query contains the first value of each query parameter, e.g. {{ .Query.id }}
+	Query map[string]string
+	// JSON contains the fields of the request body decoded as json object (empty if the body is not a json object), e.g. {{ .JSON.name }}
+	// use JSONPath for other json values
+	JSON map[string]interface{}
+
+	in *IncomingRequest
+}
+
+// PathParam returns the value of a named path segment (see RequestExpectation.PathParams)
+func (c *TemplateContext) PathParam(name string) string {
+	return c.in.PathParams[name]
+}
+
+// Header returns the first value of the request header
+func (c *TemplateContext) Header(name string) string {
+	return c.in.R.Header.Get(name)
+}
+
+// Body returns the request body
+func (c *TemplateContext) Body() string {
+	return string(c.in.Body)
+}
+
+// JSONPath returns the value of the json path in the request body (e.g. "$.name")
+func (c *TemplateContext) JSONPath(path string) (interface{}, error) {
+	body, err := c.in.JSON()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse json body: %v", err)
+	}
+	return jsonpath.JsonPathLookup(body, path)
+}
+
+func newTemplateContext(in *IncomingRequest, count int) *TemplateContext {
+	ctx := &TemplateContext{
+		Count:      count,
+		Method:     in.R.Method,
+		Path:       in.R.URL.Path,
+		PathParams: in.PathParams,
+		Query:      make(map[string]string, len(in.Query)),
+		in:         in,
+	}
+	if ctx.PathParams == nil {
+		ctx.PathParams = map[string]string{}
+	}
+	for key := range in.Query {
+		ctx.Query[key] = in.Query.Get(key)
+	}
+	ctx.JSON = map[string]interface{}{}
+	if len(in.Body) > 0 {
+		if body, err := in.JSON(); err == nil {
+			if object, ok := body.(map[string]interface{}); ok {
+				ctx.JSON = object
+			}
+		}
+	}
+	return ctx
+}
+
+// responseTemplates contains the templates of a response, they are rendered for each matching call
+type responseTemplates struct {
+	body    *template.Template
+	headers map[string]*template.Template
+}
+
+// render replaces the body and headers of the response by its rendered templates
+// it is called on a copy of the response
+func (resp *MockResponse) render(in *IncomingRequest, count int) error {
+	if resp.templates == nil {
+		return nil
+	}
+
+	ctx := newTemplateContext(in, count)
+	if resp.templates.body != nil {
+		var buf bytes.Buffer
+		if err := resp.templates.body.Execute(&buf, ctx); err != nil {
+			return err
+		}
+		resp.Body = buf.Bytes()
+	}
+	for key, tmpl := range resp.templates.headers {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, ctx); err != nil {
+			return err
+		}
+		resp.Headers[key] = buf.String()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package httpmockserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// matchTrace collects the match attempts of a single request for Opts.DebugLog
+// all methods are no-ops on a nil trace, so the matching code does not need to check whether debugging is enabled
+type matchTrace struct {
+	out io.Writer
+	buf bytes.Buffer
+}
+
+// newMatchTrace returns a trace for the request, nil if Opts.DebugLog is not set
+func (s *mockServer) newMatchTrace(in *IncomingRequest) *matchTrace {
+	if s.debugLog == nil {
+		return nil
+	}
+	trace := &matchTrace{out: s.debugLog}
+	trace.buf.WriteString(fmt.Sprintf("httpmockserver: %v %v\n", in.R.Method, in.R.URL.RequestURI()))
+	return trace
+}
+
+// attempt records the outcome of matching the expectation of the given kind (EXPECT, DEFAULT or EVERY)
+// the expectation is numbered by its position in the list it was registered to (starting at 1)
+func (trace *matchTrace) attempt(kind string, exp *requestExpectation, list []*requestExpectation, format string, args ...interface{}) {
+	if trace == nil {
+		return
+	}
+	n := 0
+	for i, other := range list {
+		if other == exp {
+			n = i + 1
+			break
+		}
+	}
+	trace.buf.WriteString(fmt.Sprintf("  %v %d (%v): %v\n", kind, n, traceDescription(exp), fmt.Sprintf(format, args...)))
+}
+
+// printf records a line that does not belong to a single expectation
+func (trace *matchTrace) printf(format string, args ...interface{}) {
+	if trace == nil {
+		return
+	}
+	trace.buf.WriteString("  " + fmt.Sprintf(format, args...) + "\n")
+}
+
+// flush writes the collected trace at once, so traces of concurrent requests do not interleave
+func (trace *matchTrace) flush() {
+	if trace == nil {
+		return
+	}
+	_, _ = trace.out.Write(trace.buf.Bytes())
+}
+
+// traceDescription describes the expectation by its validations (e.g. GET AND Path: /users)
+func traceDescription(exp *requestExpectation) string {
+	if len(exp.requestValidations) == 0 {
+		return "any request"
+	}
+	return defaultDescription(exp, len(exp.requestValidations))
+}
+
+// validationFailure describes a failed validation for the trace
+func validationFailure(val *requestValidation, err error) string {
+	return fmt.Sprintf("not matched: %v: %v", val.description, strings.TrimPrefix(err.Error(), "request validation failed: "))
+}
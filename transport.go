@@ -0,0 +1,113 @@
+package httpmockserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"syscall"
+)
+
+// transport is a http.RoundTripper that passes requests directly to the handler of the mock server (see MockServer.Transport)
+type transport struct {
+	server *mockServer
+}
+
+func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the request is cloned, a RoundTripper must not modify the request of the client
+	in := req.Clone(req.Context())
+	in.RequestURI = req.URL.RequestURI()
+	in.Host = req.URL.Host
+	if req.Host != "" {
+		in.Host = req.Host
+	}
+	in.RemoteAddr = "127.0.0.1:0"
+	if in.Body == nil {
+		in.Body = http.NoBody
+	}
+	defer in.Body.Close()
+
+	recorder := &transportRecorder{ResponseRecorder: httptest.NewRecorder()}
+	tr.server.ServeHTTP(recorder, in)
+	if recorder.err != nil {
+		return nil, recorder.err
+	}
+	if recorder.raw != nil {
+		// raw bytes are parsed like a client reading them from the connection
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(recorder.raw)), req)
+		if err != nil {
+			return nil, fmt.Errorf("malformed HTTP response: %w", err)
+		}
+		resp.Close = true
+		return resp, nil
+	}
+
+	resp := recorder.Result()
+	if recorder.malformed {
+		// the client reads up to the announced Content-Length and fails if the connection is closed before
+		data := recorder.Body.Bytes()
+		var body io.Reader = bytes.NewReader(data)
+		if int64(len(data)) > recorder.contentLength {
+			body = bytes.NewReader(data[:recorder.contentLength])
+		} else if int64(len(data)) < recorder.contentLength {
+			body = io.MultiReader(body, truncatedBody{})
+		}
+		resp.Body = io.NopCloser(body)
+		resp.ContentLength = recorder.contentLength
+		resp.Header.Set("Content-Length", strconv.FormatInt(recorder.contentLength, 10))
+		resp.Close = true
+	}
+	if recorder.truncated {
+		// the body ends like a connection closed in the middle of a chunked body
+		resp.Body = io.NopCloser(io.MultiReader(resp.Body, truncatedBody{}))
+		resp.ContentLength = -1
+	}
+	if recorder.http10 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.0", 1, 0
+		resp.Close = true
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// transportRecorder records the response of the mock server and turns connection faults into errors
+// that resemble the errors of a network connection
+type transportRecorder struct {
+	*httptest.ResponseRecorder
+	err error
+	// truncated is set if the connection is closed after the response was flushed (see ResponseExpectation.TruncateStream)
+	truncated bool
+	// raw contains the bytes written instead of a response (see RequestExpectation.RawBytes)
+	raw []byte
+	// malformed is set if the response announces contentLength instead of the length of the written body
+	// (see ResponseExpectation.TruncateBodyAfter and OverrideContentLength)
+	malformed     bool
+	contentLength int64
+	// http10 is set if the response is written as HTTP/1.0 (see ResponseExpectation.HTTP10)
+	http10 bool
+}
+
+func (rec *transportRecorder) fault(fault ConnectionFault) {
+	if rec.Flushed {
+		rec.truncated = true
+		return
+	}
+
+	switch fault {
+	case ResetConnection:
+		rec.err = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	case CloseConnection:
+		rec.err = io.EOF
+	}
+}
+
+// truncatedBody fails reading like the body of a response whose connection was closed unexpectedly
+type truncatedBody struct{}
+
+func (truncatedBody) Read([]byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
@@ -2,13 +2,30 @@ package httpmockserver
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/oliveagle/jsonpath"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/url"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type RequestValidationFunc func(r *IncomingRequest) error
@@ -17,13 +34,41 @@ type requestValidation struct {
 	validation  RequestValidationFunc
 	description string
 	satisfied   bool
+	headOnly    bool
+	// stream validations read the body as a stream (see BodyStreamFunc)
+	stream bool
 }
 
 func (val *requestValidation) String() string {
 	return val.description
 }
 
+// deferred reports whether the validation streams the unread body of the request (see Opts.LazyBody)
+// such a validation is not checked while matching, it runs after matching without holding the handler lock
+func (val *requestValidation) deferred(in *IncomingRequest) bool {
+	return val.stream && in.unreadBody != nil
+}
+
 var (
+	anyOfValidation = func(alternatives [][]*requestValidation) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			errs := make([]string, 0, len(alternatives))
+		nextAlternative:
+			for i, alternative := range alternatives {
+				for _, val := range alternative {
+					if err := val.validation(in); err != nil {
+						errs = append(errs, fmt.Sprintf("%d. %v", i+1, strings.TrimPrefix(err.Error(), "request validation failed: ")))
+						continue nextAlternative
+					}
+				}
+
+				return nil
+			}
+
+			return fmt.Errorf("request validation failed: none of the alternatives matched:\n%v", strings.Join(errs, "\n"))
+		}
+	}
+
 	bodyFuncValidation = func(bodyValidation func(body []byte) error) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
 			if err := bodyValidation(in.Body); err != nil {
@@ -34,35 +79,104 @@ var (
 		}
 	}
 
+	bodyStreamFuncValidation = func(bodyValidation func(body io.Reader) error) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if err := bodyValidation(in.BodyReader()); err != nil {
+				return fmt.Errorf("request validation failed: custom body stream validation failure: %v", err.Error())
+			}
+
+			return nil
+		}
+	}
+
 	bodyValidation = func(data []byte) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
 
 			if !bytes.Equal(data, in.Body) {
-				return fmt.Errorf("request validation failed: body should be %v but was %v", string(data), string(in.Body))
+				return fmt.Errorf("request validation failed: %v", bodyMismatch(data, in.Body, in.verbose))
 			}
 
 			return nil
 		}
 	}
 
-	stringBodyContainsValidation = func(substring string) RequestValidationFunc {
+	contentLengthMatchesBodyValidation = func() RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			stringBody := string(in.Body)
+			// unknown length (e.g. chunked transfer encoding)
+			if in.R.ContentLength < 0 {
+				return nil
+			}
+
+			if in.R.ContentLength != int64(len(in.Body)) {
+				return fmt.Errorf("request validation failed: Content-Length was %v but body length was %v", in.R.ContentLength, len(in.Body))
+			}
+
+			return nil
+		}
+	}
+
+	bodyLengthValidation = func(min, max int) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			length := len(in.Body)
+			if length < min {
+				return fmt.Errorf("request validation failed: body length %d is below min %d", length, min)
+			}
+
+			if length > max {
+				return fmt.Errorf("request validation failed: body length %d exceeds max %d", length, max)
+			}
+
+			return nil
+		}
+	}
+
+	multipartCountValidation = func(n int, files bool) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			fields, fileParts, err := countMultipartParts(in)
+			if err != nil {
+				return fmt.Errorf("request validation failed: %v", err)
+			}
+
+			kind, count := "fields", fields
+			if files {
+				kind, count = "files", fileParts
+			}
+			if count != n {
+				return fmt.Errorf("request validation failed: expected %d multipart %v but was %d (%d fields, %d files)", n, kind, count, fields, fileParts)
+			}
+
+			return nil
+		}
+	}
 
-			if !strings.Contains(stringBody, substring) {
-				return fmt.Errorf("request validation failed: body should contain %v but was %v", substring, stringBody)
+	stringBodyContainsValidation = func(substring string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if !strings.Contains(string(in.Body), substring) {
+				return fmt.Errorf("request validation failed: body should contain %v but was %v", substring, bodyString(in))
 			}
 
 			return nil
 		}
 	}
 
-	stringBodyMatchValidation = func(regex string) RequestValidationFunc {
+	stringBodyMatchValidation = func(regex *regexp.Regexp) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
 			stringBody := string(in.Body)
 
-			if !regexp.MustCompile(regex).MatchString(stringBody) {
-				return fmt.Errorf("request validation failed: body should match %v but was %v", regex, stringBody)
+			matches := regex.FindStringSubmatch(stringBody)
+			if matches == nil {
+				return fmt.Errorf("request validation failed: body should match %v but was %v", regex, bodyString(in))
+			}
+			in.BodyMatches = matches
+
+			return nil
+		}
+	}
+
+	bodyMatchesValidation = func(regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if !regex.Match(in.Body) {
+				return fmt.Errorf("request validation failed: body should match %v but was %q", regex.String(), bodyString(in))
 			}
 
 			return nil
@@ -89,290 +203,1619 @@ var (
 				return fmt.Errorf("request validation failed: could not parse expected json body %+v: %v", expectedJson, err)
 			}
 
-			var normJsActual map[string]interface{}
-			err = json.Unmarshal(in.Body, &normJsActual)
+			normJsActual, err := in.JSON()
 			if err != nil {
-				return fmt.Errorf("request validation failed: could not parse actual json body %+v: %v", in.Body, err)
+				return fmt.Errorf("request validation failed: could not parse actual json body %v: %v", bodyString(in), err)
 			}
 
-			normStringActual, _ := json.Marshal(normJsActual)
-			normStringExpected, _ := json.Marshal(normJsExpected)
-
-			if !bytes.Equal(normStringActual, normStringExpected) {
-				return fmt.Errorf("request validation failed: json body should be %+v but was %+v", normStringExpected, normStringActual)
+			// both documents are decoded into generic values, so the field order does not matter
+			if diff := jsonDiff("$", normJsExpected, normJsActual, false); len(diff) > 0 {
+				return fmt.Errorf("request validation failed: json body did not match:\n%v", strings.Join(diff, "\n"))
 			}
 
 			return nil
 		}
 	}
 
-	jsonPathContainsValidation = func(jsPath string, value interface{}) RequestValidationFunc {
+	yamlBodyValidation = func(expectedYaml interface{}) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			var jsBodyObject map[string]interface{}
-			err := json.Unmarshal(in.Body, &jsBodyObject)
-			if err != nil {
-				return fmt.Errorf("request validation failed: could not parse json body %+v: %v", in.Body, err)
-			}
-
-			res, err := jsonpath.JsonPathLookup(jsBodyObject, jsPath)
-			if err != nil {
-				return fmt.Errorf("request validation failed: could not find json path %v in body %+v: %v", jsPath, in.Body, err)
-			}
+			var yamlExpected []byte
+			var err error
 
-			if reflect.DeepEqual(res, value) {
-				return nil
+			if str, ok := expectedYaml.(string); ok {
+				yamlExpected = []byte(str)
+			} else {
+				yamlExpected, err = yaml.Marshal(expectedYaml)
+				if err != nil {
+					return fmt.Errorf("request validation failed: could not parse provided yaml body %+v: %v", expectedYaml, err)
+				}
 			}
 
-			return fmt.Errorf("request validation failed: json path %v should be %+v but was %+v", jsPath, value, res)
-		}
-	}
-
-	jsonPathMatchesValidation = func(jsPath string, regex string) RequestValidationFunc {
-		return func(in *IncomingRequest) error {
-			var jsBodyObject map[string]interface{}
-			err := json.Unmarshal(in.Body, &jsBodyObject)
+			var normYamlExpected interface{}
+			err = yaml.Unmarshal(yamlExpected, &normYamlExpected)
 			if err != nil {
-				return fmt.Errorf("request validation failed: could not parse json body %+v: %v", in.Body, err)
+				return fmt.Errorf("request validation failed: could not parse expected yaml body %+v: %v", expectedYaml, err)
 			}
 
-			res, err := jsonpath.JsonPathLookup(jsBodyObject, jsPath)
+			var normYamlActual interface{}
+			err = yaml.Unmarshal(in.Body, &normYamlActual)
 			if err != nil {
-				return fmt.Errorf("request validation failed: could not find json path %v in body %+v: %v", jsPath, in.Body, err)
+				return fmt.Errorf("request validation failed: could not parse actual yaml body %v: %v", bodyString(in), err)
 			}
 
-			// stringify the result
-			var str = ""
-			str, ok := res.(string)
-			if !ok {
-				str = fmt.Sprintf("%v", res)
-			}
+			normStringActual, _ := yaml.Marshal(normYamlActual)
+			normStringExpected, _ := yaml.Marshal(normYamlExpected)
 
-			if regexp.MustCompile(regex).MatchString(str) {
-				return nil
+			if !bytes.Equal(normStringActual, normStringExpected) {
+				return fmt.Errorf("request validation failed: yaml body did not match (- expected, + actual):\n%v", compactLineDiff(lineDiff(string(normStringExpected), string(normStringActual)), 3))
 			}
 
-			return fmt.Errorf("request validation failed: json path %v should match %v but was %+v", jsPath, regex, res)
+			return nil
 		}
 	}
 
-	basicAuthValidation = func(user, password string) RequestValidationFunc {
+	protoBodyValidation = func(expected proto.Message) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			_user, _password, ok := in.R.BasicAuth()
-			if !ok {
-				return fmt.Errorf("request validation failed: expected authHeader was missing")
+			actual := expected.ProtoReflect().New().Interface()
+			if err := unmarshalProtoBody(in, actual); err != nil {
+				return fmt.Errorf("request validation failed: could not parse protobuf body: %v", err)
 			}
 
-			if user != _user || password != _password {
-				return fmt.Errorf("request validation failed: expected authHeader user:password %v:%v but was %v:%v", user, password, _user, _password)
+			if !proto.Equal(expected, actual) {
+				format := prototext.MarshalOptions{Multiline: true}
+				return fmt.Errorf("request validation failed: protobuf body did not match (- expected, + actual):\n%v",
+					compactLineDiff(lineDiff(format.Format(expected), format.Format(actual)), 3))
 			}
 
 			return nil
 		}
 	}
 
-	basicAuthExistsValidation = func() RequestValidationFunc {
+	expectBodyValidation = func(expected interface{}) RequestValidationFunc {
+		if data, ok := expected.([]byte); ok {
+			expected = string(data)
+		}
+
 		return func(in *IncomingRequest) error {
-			_, _, ok := in.R.BasicAuth()
-			if !ok {
-				return fmt.Errorf("request validation failed: expected authHeader was missing")
+			mediaType, _, _ := mime.ParseMediaType(in.R.Header.Get("Content-Type"))
+
+			switch {
+			case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+				return jsonBodyValidation(expected)(in)
+			case mediaType == "application/yaml" || mediaType == "application/x-yaml" || mediaType == "text/yaml" || strings.HasSuffix(mediaType, "+yaml"):
+				return yamlBodyValidation(expected)(in)
+			case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+				return xmlBodyValidation(expected)(in)
+			case mediaType == "application/x-www-form-urlencoded":
+				return formBodyValidation(expected)(in)
 			}
 
-			return nil
+			str, ok := expected.(string)
+			if !ok {
+				return fmt.Errorf("request validation failed: body of content type %q can only be compared with a string or []byte but got %T", mediaType, expected)
+			}
+			return bodyValidation([]byte(str))(in)
 		}
 	}
 
-	jwtTokenExistsValidation = func() RequestValidationFunc {
+	xmlBodyValidation = func(expectedXml interface{}) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			authHeader := in.R.Header.Get("Authorization")
-			if authHeader == "" {
-				return fmt.Errorf("request validation failed: expected authHeader was missing")
+			var xmlExpected []byte
+			var err error
+
+			if str, ok := expectedXml.(string); ok {
+				xmlExpected = []byte(str)
+			} else {
+				xmlExpected, err = xml.Marshal(expectedXml)
+				if err != nil {
+					return fmt.Errorf("request validation failed: could not parse provided xml body %+v: %v", expectedXml, err)
+				}
 			}
-			if !strings.HasPrefix(authHeader, "Bearer ") {
-				return fmt.Errorf("request validation failed: Bearer prefix was missing")
+
+			normXmlExpected, err := normalizeXML(xmlExpected)
+			if err != nil {
+				return fmt.Errorf("request validation failed: could not parse expected xml body %+v: %v", expectedXml, err)
 			}
 
-			token := strings.TrimPrefix(authHeader, "Bearer ")
+			normXmlActual, err := normalizeXML(in.Body)
+			if err != nil {
+				return fmt.Errorf("request validation failed: could not parse actual xml body %v: %v", bodyString(in), err)
+			}
 
-			if token == "" {
-				return fmt.Errorf("request validation failed: bearer token was empty")
+			if normXmlActual != normXmlExpected {
+				return fmt.Errorf("request validation failed: xml body did not match (- expected, + actual):\n%v", lineDiff(normXmlExpected, normXmlActual))
 			}
 
 			return nil
 		}
 	}
 
-	jwtTokenClaimPathValidation = func(jsPath string, value interface{}) RequestValidationFunc {
+	formBodyValidation = func(expectedForm interface{}) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if err := jwtTokenExistsValidation()(in); err != nil {
-				return err
+			var formExpected url.Values
+			var err error
+
+			switch expected := expectedForm.(type) {
+			case string:
+				formExpected, err = url.ParseQuery(expected)
+				if err != nil {
+					return fmt.Errorf("request validation failed: could not parse expected form body %v: %v", expected, err)
+				}
+			case url.Values:
+				formExpected = expected
+			case map[string][]string:
+				formExpected = expected
+			case map[string]string:
+				formExpected = url.Values{}
+				for key, value := range expected {
+					formExpected.Set(key, value)
+				}
+			default:
+				return fmt.Errorf("request validation failed: form body can only be compared with a string, url.Values or map[string]string but got %T", expectedForm)
+			}
+
+			if in.formErr != nil {
+				return formParseError(in)
 			}
 
-			token := strings.TrimPrefix(in.R.Header.Get("Authorization"), "Bearer ")
+			formActual := in.PostForm
+			if !reflect.DeepEqual(formExpected, formActual) {
+				return fmt.Errorf("request validation failed: form body should be %v but was %v", formExpected.Encode(), formActual.Encode())
+			}
 
-			parsedToken, _ := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-				return nil, nil
-			})
+			return nil
+		}
+	}
 
-			claims, ok := parsedToken.Claims.(jwt.MapClaims)
-			if !ok {
-				return fmt.Errorf("request validation failed: could not retrieve claims from token")
+	jsonPathContainsValidation = func(jsPath string, value interface{}) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			jsBodyObject, err := in.JSON()
+			if err != nil {
+				return fmt.Errorf("request validation failed: could not parse json body %v: %v", bodyString(in), err)
 			}
 
-			res, err := jsonpath.JsonPathLookup(claims, jsPath)
+			res, err := jsonpath.JsonPathLookup(jsBodyObject, jsPath)
 			if err != nil {
-				return fmt.Errorf("request validation failed: could not retrieve claim with path %s from token", jsPath)
+				return fmt.Errorf("request validation failed: could not find json path %v in body %v: %v", jsPath, bodyString(in), err)
 			}
 
-			if !reflect.DeepEqual(res, value) {
-				return fmt.Errorf("request validation failed: expected claim on path %s to be %v but was %v", jsPath, value, res)
+			if valuesEqual(res, value) {
+				return nil
 			}
 
-			return nil
+			return fmt.Errorf("request validation failed: json path %v should be %+v but was %+v", jsPath, value, res)
 		}
 	}
 
-	pathValidation = func(path string) RequestValidationFunc {
+	strictJSONBodyContainsValidation = func(expected interface{}) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.URL.Path != path {
-				return fmt.Errorf("request validation failed: expected path %v but was %v", path, in.R.URL.Path)
+			var expectedJSON []byte
+			if str, ok := expected.(string); ok {
+				expectedJSON = []byte(str)
+			} else {
+				var err error
+				expectedJSON, err = json.Marshal(expected)
+				if err != nil {
+					return fmt.Errorf("request validation failed: could not parse provided json body %+v: %v", expected, err)
+				}
+			}
+
+			// numbers are decoded as json.Number, so integers and decimal numbers can be told apart
+			var normExpected interface{}
+			if err := decodeJSONNumbers(expectedJSON, &normExpected); err != nil {
+				return fmt.Errorf("request validation failed: could not parse expected json body %+v: %v", expected, err)
+			}
+
+			var normActual interface{}
+			if err := decodeJSONNumbers(in.Body, &normActual); err != nil {
+				return fmt.Errorf("request validation failed: could not parse actual json body %v: %v", bodyString(in), err)
+			}
+
+			// the first difference is reported, the document is expected to match exactly including the kind of its numbers
+			diff := jsonDiff("$", normExpected, normActual, false)
+			if len(diff) == 0 {
+				diff = jsonNumberKindDiff("$", normExpected, normActual)
+			}
+			if len(diff) > 0 {
+				return fmt.Errorf("request validation failed: %v", diff[0])
 			}
 
 			return nil
 		}
 	}
 
-	pathRegexValidation = func(pathRegex string) RequestValidationFunc {
-		regex := regexp.MustCompile(pathRegex)
+	jsonBodyContainsValidation = func(expected interface{}) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if !regex.MatchString(in.R.URL.Path) {
-				return fmt.Errorf("request validation failed: pathRegex %v did not match %v", pathRegex, in.R.URL.Path)
+			var expectedJSON []byte
+			if str, ok := expected.(string); ok {
+				expectedJSON = []byte(str)
+			} else {
+				var err error
+				expectedJSON, err = json.Marshal(expected)
+				if err != nil {
+					return fmt.Errorf("request validation failed: could not parse provided json body %+v: %v", expected, err)
+				}
+			}
+
+			var normExpected interface{}
+			if err := json.Unmarshal(expectedJSON, &normExpected); err != nil {
+				return fmt.Errorf("request validation failed: could not parse expected json body %+v: %v", expected, err)
+			}
+
+			normActual, err := in.JSON()
+			if err != nil {
+				return fmt.Errorf("request validation failed: could not parse actual json body %v: %v", bodyString(in), err)
+			}
+
+			// additional fields of the actual body are ignored at any level
+			if diff := jsonDiff("$", normExpected, normActual, true); len(diff) > 0 {
+				return fmt.Errorf("request validation failed: json body did not contain the expected fields:\n%v", strings.Join(diff, "\n"))
 			}
 
 			return nil
 		}
 	}
 
-	headerValidation = func(key, value string) RequestValidationFunc {
+	headersExactlyValidation = func(expected []string) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.Header.Get(key) == "" {
-				return fmt.Errorf("request validation failed: header %v was missing", key)
+			allowed := make(map[string]bool, len(expected))
+			for _, name := range expected {
+				allowed[name] = true
 			}
 
-			if in.R.Header.Get(key) != value {
-				return fmt.Errorf("request validation failed: expected header %v to be %v but was %v", key, value, in.R.Header.Get(key))
+			var unexpected []string
+			for _, name := range sortedKeys(in.R.Header) {
+				if !allowed[name] && !in.headerIgnored(name) {
+					unexpected = append(unexpected, name)
+				}
+			}
+			if len(unexpected) > 0 {
+				return fmt.Errorf("request validation failed: unexpected header(s): %v", strings.Join(unexpected, ", "))
 			}
 
 			return nil
 		}
 	}
 
-	headerExistsValidation = func(key string) RequestValidationFunc {
+	strictHeadersValidation = func(expected []string) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.Header.Get(key) == "" {
-				return fmt.Errorf("request validation failed: header %v was missing", key)
+			names := make([]string, 0, len(in.R.Header))
+			for name := range in.R.Header {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+		nextHeader:
+			for _, name := range names {
+				if in.headerIgnored(name) {
+					continue
+				}
+				for _, expectedName := range expected {
+					if name == expectedName {
+						continue nextHeader
+					}
+				}
+
+				return fmt.Errorf("request validation failed: unexpected header %v (strict matching)", name)
 			}
 
 			return nil
 		}
 	}
 
-	headerMatchesValidation = func(key, regex string) RequestValidationFunc {
+	jsonPathMatchesValidation = func(jsPath string, regex *regexp.Regexp) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.Header.Get(key) == "" {
-				return fmt.Errorf("request validation failed: header %v was missing", key)
+			jsBodyObject, err := in.JSON()
+			if err != nil {
+				return fmt.Errorf("request validation failed: could not parse json body %v: %v", bodyString(in), err)
 			}
 
-			if !regexp.MustCompile(regex).MatchString(in.R.Header.Get(key)) {
-				return fmt.Errorf("request validation failed: header %v did not match regex %v", key, regex)
+			res, err := jsonpath.JsonPathLookup(jsBodyObject, jsPath)
+			if err != nil {
+				return fmt.Errorf("request validation failed: could not find json path %v in body %v: %v", jsPath, bodyString(in), err)
 			}
 
-			return nil
+			// stringify the result
+			var str = ""
+			str, ok := res.(string)
+			if !ok {
+				str = fmt.Sprintf("%v", res)
+			}
+
+			if regex.MatchString(str) {
+				return nil
+			}
+
+			return fmt.Errorf("request validation failed: json path %v should match %v but was %+v", jsPath, regex, res)
 		}
 	}
 
-	formParameterValidation = func(key, value string) RequestValidationFunc {
+	basicAuthValidation = func(user, password string) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.Form.Get(key) == "" {
-				return fmt.Errorf("request validation failed: form parameter %v was missing", key)
+			_user, _password, ok := in.R.BasicAuth()
+			if !ok {
+				return fmt.Errorf("request validation failed: expected authHeader was missing")
 			}
 
-			if in.R.Form.Get(key) != value {
-				return fmt.Errorf("request validation failed: expected form parameter %v to be %v but was %v", key, value, in.R.Form.Get(key))
+			if user != _user || password != _password {
+				return fmt.Errorf("request validation failed: expected authHeader user:password %v:%v but was %v:%v", user, password, _user, _password)
 			}
 
 			return nil
 		}
 	}
 
-	formParameterExistsValidation = func(name string) RequestValidationFunc {
+	basicAuthExistsValidation = func() RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.Form.Get(name) == "" {
-				return fmt.Errorf("request validation failed: form parameter %v was missing", name)
+			_, _, ok := in.R.BasicAuth()
+			if !ok {
+				return fmt.Errorf("request validation failed: expected authHeader was missing")
 			}
 
 			return nil
 		}
 	}
 
-	formParameterMatchesValidation = func(key, regex string) RequestValidationFunc {
+	oauth2ClientCredentialsValidation = func(clientID, clientSecret string) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.Form.Get(key) == "" {
-				return fmt.Errorf("request validation failed: form parameter %v was missing", key)
-			}
+			// credentials may be url encoded in the basic auth header (see RFC 6749 section 2.3.1)
+			if user, password, ok := in.R.BasicAuth(); ok {
+				if decoded, err := url.QueryUnescape(user); err == nil {
+					user = decoded
+				}
+				if decoded, err := url.QueryUnescape(password); err == nil {
+					password = decoded
+				}
 
-			if !regexp.MustCompile(regex).MatchString(in.R.Form.Get(key)) {
-				return fmt.Errorf("request validation failed: form parameter %v did not match regex %v", key, regex)
+				if user != clientID || password != clientSecret {
+					return fmt.Errorf("request validation failed: expected client credentials %v:%v in basic auth but was %v:%v", clientID, clientSecret, user, password)
+				}
+
+				return nil
 			}
 
-			return nil
-		}
-	}
+			if in.formErr != nil {
+				return formParseError(in)
+			}
 
-	queryParameterValidation = func(key, value string) RequestValidationFunc {
-		return func(in *IncomingRequest) error {
-			if in.R.URL.Query().Get(key) == "" {
-				return fmt.Errorf("request validation failed: query parameter %v was missing", key)
+			if in.PostForm.Get("client_id") == "" {
+				return fmt.Errorf("request validation failed: client credentials were missing (neither basic auth nor client_id form parameter)")
 			}
 
-			if in.R.URL.Query().Get(key) != value {
-				return fmt.Errorf("request validation failed: expected query parameter %v to be %v but was %v", key, value, in.R.Form.Get(key))
+			if in.PostForm.Get("client_id") != clientID || in.PostForm.Get("client_secret") != clientSecret {
+				return fmt.Errorf("request validation failed: expected client credentials %v:%v in form but was %v:%v", clientID, clientSecret, in.PostForm.Get("client_id"), in.PostForm.Get("client_secret"))
 			}
 
 			return nil
 		}
 	}
 
-	queryParameterExistsValidation = func(name string) RequestValidationFunc {
+	jwtTokenExistsValidation = func() RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.URL.Query().Get(name) == "" {
-				return fmt.Errorf("request validation failed: query parameter %v was missing", name)
+			authHeader := in.R.Header.Get("Authorization")
+			if authHeader == "" {
+				return fmt.Errorf("request validation failed: expected authHeader was missing")
+			}
+			if !strings.HasPrefix(authHeader, "Bearer ") {
+				return fmt.Errorf("request validation failed: Bearer prefix was missing")
+			}
+
+			token := strings.TrimPrefix(authHeader, "Bearer ")
+
+			if token == "" {
+				return fmt.Errorf("request validation failed: bearer token was empty")
 			}
 
 			return nil
 		}
 	}
 
-	queryParameterMatchesValidation = func(key, regex string) RequestValidationFunc {
+	jwtTokenClaimPathValidation = func(jsPath string, value interface{}) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if in.R.URL.Query().Get(key) == "" {
-				return fmt.Errorf("request validation failed: query parameter %v was missing", key)
+			res, err := jwtTokenClaimLookup(in, jsPath)
+			if err != nil {
+				return err
 			}
 
-			if !regexp.MustCompile(regex).MatchString(in.R.Form.Get(key)) {
-				return fmt.Errorf("request validation failed: query parameter %v did not match regex %v", key, regex)
+			if !valuesEqual(res, value) {
+				return fmt.Errorf("request validation failed: expected claim on path %s to be %v but was %v", jsPath, value, res)
 			}
 
 			return nil
 		}
 	}
 
-	methodValidation = func(method string) RequestValidationFunc {
+	jwtTokenClaimMatchesValidation = func(jsPath string, regex *regexp.Regexp) RequestValidationFunc {
 		return func(in *IncomingRequest) error {
-			if !strings.EqualFold(in.R.Method, method) {
-				return fmt.Errorf("request validation failed: expected method %v but was %v", method, in.R.Method)
+			res, err := jwtTokenClaimLookup(in, jsPath)
+			if err != nil {
+				return err
+			}
+
+			if !regex.MatchString(stringify(res)) {
+				return fmt.Errorf("request validation failed: expected claim on path %s to match %v but was %v", jsPath, regex, res)
+			}
+
+			return nil
+		}
+	}
+
+	jwtTokenClaimsValidation = func(expected map[string]interface{}) RequestValidationFunc {
+		keys := make([]string, 0, len(expected))
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		return func(in *IncomingRequest) error {
+			claims, err := jwtTokenClaims(in)
+			if err != nil {
+				return err
+			}
+
+			var missing, mismatched []string
+			for _, key := range keys {
+				actual, ok := claims[key]
+				if !ok {
+					missing = append(missing, key)
+					continue
+				}
+				if !valuesEqual(actual, expected[key]) {
+					mismatched = append(mismatched, fmt.Sprintf("%v (expected %v but was %v)", key, expected[key], actual))
+				}
+			}
+
+			if len(missing) > 0 || len(mismatched) > 0 {
+				return fmt.Errorf("request validation failed: token claims did not match: missing claims: %v, mismatched claims: %v", missing, mismatched)
+			}
+
+			return nil
+		}
+	}
+
+	jwtTokenNotExpiredValidation = func() RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			claims, err := jwtTokenClaims(in)
+			if err != nil {
+				return err
+			}
+
+			expiresAt, err := timeClaim(claims, "exp")
+			if err != nil {
+				return err
+			}
+
+			now := in.Now()
+			if !now.Before(expiresAt) {
+				return fmt.Errorf("request validation failed: token expired at %v (now: %v)", expiresAt, now)
+			}
+
+			// the nbf claim is optional, but a token must not be used before it
+			if _, ok := claims["nbf"]; ok {
+				notBefore, err := timeClaim(claims, "nbf")
+				if err != nil {
+					return err
+				}
+				if now.Before(notBefore) {
+					return fmt.Errorf("request validation failed: token is not valid before %v (now: %v)", notBefore, now)
+				}
+			}
+
+			return nil
+		}
+	}
+
+	jwtTokenExpiresWithinValidation = func(d time.Duration) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			expiresAt, err := jwtTokenTimeClaim(in, "exp")
+			if err != nil {
+				return err
+			}
+
+			now := in.Now()
+			if !now.Before(expiresAt) {
+				return fmt.Errorf("request validation failed: token expired at %v (now: %v)", expiresAt, now)
+			}
+
+			if expiresAt.After(now.Add(d)) {
+				return fmt.Errorf("request validation failed: expected token to expire within %v but it expires at %v (now: %v)", d, expiresAt, now)
+			}
+
+			return nil
+		}
+	}
+
+	jwtTokenIssuedWithinValidation = func(d time.Duration) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			issuedAt, err := jwtTokenTimeClaim(in, "iat")
+			if err != nil {
+				return err
+			}
+
+			now := in.Now()
+			if issuedAt.After(now) {
+				return fmt.Errorf("request validation failed: token was issued in the future at %v (now: %v)", issuedAt, now)
+			}
+
+			if issuedAt.Before(now.Add(-d)) {
+				return fmt.Errorf("request validation failed: expected token to be issued within %v but it was issued at %v (now: %v)", d, issuedAt, now)
+			}
+
+			return nil
+		}
+	}
+
+	pathValidation = func(path string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.URL.Path != path {
+				return fmt.Errorf("request validation failed: expected path %v but was %v", path, in.R.URL.Path)
+			}
+
+			return nil
+		}
+	}
+
+	pathRegexValidation = func(regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if !regex.MatchString(in.R.URL.Path) {
+				return fmt.Errorf("request validation failed: pathRegex %v did not match %v", regex, in.R.URL.Path)
+			}
+
+			return nil
+		}
+	}
+
+	pathParamsValidation = func(pattern string) RequestValidationFunc {
+		patternSegments := strings.Split(pattern, "/")
+		return func(in *IncomingRequest) error {
+			pathSegments := strings.Split(in.R.URL.Path, "/")
+			if len(pathSegments) != len(patternSegments) {
+				return fmt.Errorf("request validation failed: path %v did not match pattern %v", in.R.URL.Path, pattern)
+			}
+
+			params := make(map[string]string)
+			for i, segment := range patternSegments {
+				if strings.HasPrefix(segment, ":") && pathSegments[i] != "" {
+					params[strings.TrimPrefix(segment, ":")] = pathSegments[i]
+					continue
+				}
+
+				if segment != pathSegments[i] {
+					return fmt.Errorf("request validation failed: path %v did not match pattern %v", in.R.URL.Path, pattern)
+				}
+			}
+
+			in.PathParams = params
+			return nil
+		}
+	}
+
+	headerValidation = func(key, value string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.Header.Get(key) == "" {
+				return fmt.Errorf("request validation failed: header %v was missing", key)
+			}
+
+			if in.R.Header.Get(key) != value {
+				return fmt.Errorf("request validation failed: expected header %v to be %v but was %v", key, value, in.R.Header.Get(key))
+			}
+
+			return nil
+		}
+	}
+
+	headerExistsValidation = func(key string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.Header.Get(key) == "" {
+				return fmt.Errorf("request validation failed: header %v was missing", key)
+			}
+
+			return nil
+		}
+	}
+
+	headerMatchesValidation = func(key string, regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.Header.Get(key) == "" {
+				return fmt.Errorf("request validation failed: header %v was missing", key)
+			}
+
+			if !regex.MatchString(in.R.Header.Get(key)) {
+				return fmt.Errorf("request validation failed: header %v did not match regex %v", key, regex)
+			}
+
+			return nil
+		}
+	}
+
+	headerFoldValidation = func(key, value string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.Header.Get(key) == "" {
+				return fmt.Errorf("request validation failed: header %v was missing", key)
+			}
+
+			if !strings.EqualFold(in.R.Header.Get(key), value) {
+				return fmt.Errorf("request validation failed: expected header %v to equal %v (case-insensitive) but was %v", key, value, in.R.Header.Get(key))
+			}
+
+			return nil
+		}
+	}
+
+	trailerValidation = func(key, value string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			// the trailer is only populated after the body was read completely, which ServeHTTP already did
+			if in.R.Trailer.Get(key) == "" {
+				return fmt.Errorf("request validation failed: trailer %v was missing", key)
+			}
+
+			if in.R.Trailer.Get(key) != value {
+				return fmt.Errorf("request validation failed: expected trailer %v to be %v but was %v", key, value, in.R.Trailer.Get(key))
+			}
+
+			return nil
+		}
+	}
+
+	acceptsValidation = func(mediaType string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			accept := in.R.Header.Values("Accept")
+			if len(accept) == 0 {
+				return fmt.Errorf("request validation failed: header Accept was missing")
+			}
+
+			if !acceptsMediaType(accept, mediaType) {
+				return fmt.Errorf("request validation failed: expected Accept header to accept %v but was %v", mediaType, strings.Join(accept, ", "))
+			}
+
+			return nil
+		}
+	}
+
+	refererValidation = func(value string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			referer := requestReferer(in)
+			if referer == "" {
+				return fmt.Errorf("request validation failed: header Referer was missing")
+			}
+
+			if referer != value {
+				return fmt.Errorf("request validation failed: expected header Referer to be %v but was %v", value, referer)
+			}
+
+			return nil
+		}
+	}
+
+	refererMatchesValidation = func(regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			referer := requestReferer(in)
+			if referer == "" {
+				return fmt.Errorf("request validation failed: header Referer was missing")
+			}
+
+			if !regex.MatchString(referer) {
+				return fmt.Errorf("request validation failed: header Referer %v did not match regex %v", referer, regex)
+			}
+
+			return nil
+		}
+	}
+
+	tlsValidation = func() RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.TLS == nil {
+				return fmt.Errorf("request validation failed: expected a TLS request but was plaintext")
+			}
+
+			return nil
+		}
+	}
+
+	tlsMinVersionValidation = func(version uint16) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.TLS == nil {
+				return fmt.Errorf("request validation failed: expected %v or higher but was plaintext", tlsVersionName(version))
+			}
+			if in.R.TLS.Version < version {
+				return fmt.Errorf("request validation failed: expected %v or higher but negotiated %v", tlsVersionName(version), tlsVersionName(in.R.TLS.Version))
+			}
+
+			return nil
+		}
+	}
+
+	remoteAddrValidation = func(ip string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			remoteIP := requestRemoteIP(in)
+			if !ipEqual(remoteIP, ip) {
+				return fmt.Errorf("request validation failed: expected remote address %v but was %v", ip, remoteIP)
+			}
+
+			return nil
+		}
+	}
+
+	forwardedForValidation = func(ip string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			chain := requestForwardedFor(in)
+			if len(chain) == 0 {
+				return fmt.Errorf("request validation failed: header X-Forwarded-For was missing")
+			}
+
+			for _, forwarded := range chain {
+				if ipEqual(forwarded, ip) {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("request validation failed: expected header X-Forwarded-For to contain %v but was %v", ip, strings.Join(chain, ", "))
+		}
+	}
+
+	formParameterValidation = func(key, value string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.formErr != nil {
+				return formParseError(in)
+			}
+
+			if in.Form.Get(key) == "" {
+				return fmt.Errorf("request validation failed: form parameter %v was missing", key)
+			}
+
+			if in.Form.Get(key) != value {
+				return fmt.Errorf("request validation failed: expected form parameter %v to be %v but was %v", key, value, in.Form.Get(key))
+			}
+
+			return nil
+		}
+	}
+
+	formParameterExistsValidation = func(name string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.formErr != nil {
+				return formParseError(in)
+			}
+
+			if in.Form.Get(name) == "" {
+				return fmt.Errorf("request validation failed: form parameter %v was missing", name)
+			}
+
+			return nil
+		}
+	}
+
+	formParameterMatchesValidation = func(key string, regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.formErr != nil {
+				return formParseError(in)
+			}
+
+			if in.Form.Get(key) == "" {
+				return fmt.Errorf("request validation failed: form parameter %v was missing", key)
+			}
+
+			if !regex.MatchString(in.Form.Get(key)) {
+				return fmt.Errorf("request validation failed: form parameter %v did not match regex %v", key, regex)
+			}
+
+			return nil
+		}
+	}
+
+	formParameterValuesValidation = func(key string, values []string) RequestValidationFunc {
+		expected := append([]string(nil), values...)
+		sort.Strings(expected)
+		return func(in *IncomingRequest) error {
+			if in.formErr != nil {
+				return formParseError(in)
+			}
+
+			actual := append([]string(nil), in.Form[key]...)
+			if len(actual) == 0 {
+				return fmt.Errorf("request validation failed: form parameter %v was missing", key)
+			}
+			sort.Strings(actual)
+
+			if !reflect.DeepEqual(expected, actual) {
+				return fmt.Errorf("request validation failed: expected form parameter %v to have values %v but was %v", key, expected, actual)
+			}
+
+			return nil
+		}
+	}
+
+	queryParameterValidation = func(key, value string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.Query.Get(key) == "" {
+				return fmt.Errorf("request validation failed: query parameter %v was missing", key)
+			}
+
+			if in.Query.Get(key) != value {
+				return fmt.Errorf("request validation failed: expected query parameter %v to be %v but was %v", key, value, in.Query.Get(key))
+			}
+
+			return nil
+		}
+	}
+
+	rawQueryValidation = func(expected string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.URL.RawQuery != expected {
+				return fmt.Errorf("request validation failed: expected raw query %q but was %q", expected, in.R.URL.RawQuery)
+			}
+
+			return nil
+		}
+	}
+
+	rawQueryMatchesValidation = func(regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if !regex.MatchString(in.R.URL.RawQuery) {
+				return fmt.Errorf("request validation failed: raw query %q did not match regex %v", in.R.URL.RawQuery, regex)
+			}
+
+			return nil
+		}
+	}
+
+	queryParametersExactlyValidation = func(keys []string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			expected := make(map[string]bool, len(keys))
+			for _, key := range keys {
+				expected[key] = true
+			}
+
+			var unexpected []string
+			for _, key := range sortedKeys(in.Query) {
+				if !expected[key] {
+					unexpected = append(unexpected, key)
+				}
+			}
+			if len(unexpected) > 0 {
+				return fmt.Errorf("request validation failed: unexpected query parameter(s): %v", strings.Join(unexpected, ", "))
+			}
+
+			for _, key := range keys {
+				if n := len(in.Query[key]); n > 1 {
+					return fmt.Errorf("request validation failed: expected query parameter %v once but was sent %v times", key, n)
+				}
+			}
+
+			return nil
+		}
+	}
+
+	queryParameterExistsValidation = func(name string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.Query.Get(name) == "" {
+				return fmt.Errorf("request validation failed: query parameter %v was missing", name)
+			}
+
+			return nil
+		}
+	}
+
+	queryParameterMatchesValidation = func(key string, regex *regexp.Regexp) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.Query.Get(key) == "" {
+				return fmt.Errorf("request validation failed: query parameter %v was missing", key)
+			}
+
+			if !regex.MatchString(in.Query.Get(key)) {
+				return fmt.Errorf("request validation failed: query parameter %v did not match regex %v", key, regex)
+			}
+
+			return nil
+		}
+	}
+
+	methodValidation = func(method string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if !strings.EqualFold(in.R.Method, method) {
+				return fmt.Errorf("request validation failed: expected method %v but was %v", method, in.R.Method)
+			}
+
+			return nil
+		}
+	}
+
+	nthRequestValidation = func(n int) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.number != n {
+				return fmt.Errorf("request validation failed: expected request %d of the mock server but was request %d", n, in.number)
+			}
+
+			return nil
+		}
+	}
+
+	methodExactValidation = func(method string) RequestValidationFunc {
+		return func(in *IncomingRequest) error {
+			if in.R.Method != method {
+				return fmt.Errorf("request validation failed: expected method %v (case-sensitive) but was %v", method, in.R.Method)
 			}
 
 			return nil
 		}
 	}
 )
+
+// unmarshalProtoBody decodes the request body into msg according to the Content-Type of the request
+// grpc, grpc-web and connect streaming bodies are unwrapped from their message frame (grpc-web-text is base64 decoded first),
+// json bodies are decoded using protojson, all other bodies are decoded as binary protobuf (e.g. application/proto)
+func unmarshalProtoBody(in *IncomingRequest, msg proto.Message) error {
+	mediaType, _, _ := mime.ParseMediaType(in.R.Header.Get("Content-Type"))
+	body := in.Body
+
+	if strings.HasPrefix(mediaType, "application/grpc-web-text") {
+		decoded, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return fmt.Errorf("invalid base64 body: %v", err)
+		}
+		body = decoded
+	}
+
+	if strings.HasPrefix(mediaType, "application/grpc") || strings.HasPrefix(mediaType, "application/connect+") {
+		// a frame consists of a flag byte, the big endian message length (4 bytes) and the message
+		if len(body) < 5 {
+			return fmt.Errorf("message frame too short: %d bytes", len(body))
+		}
+		if body[0]&0x01 != 0 {
+			return fmt.Errorf("compressed messages are not supported")
+		}
+		length := binary.BigEndian.Uint32(body[1:5])
+		if uint32(len(body)-5) < length {
+			return fmt.Errorf("message frame declares %d bytes but contains %d", length, len(body)-5)
+		}
+		body = body[5 : 5+length]
+	}
+
+	if strings.HasSuffix(mediaType, "json") {
+		return protojson.Unmarshal(body, msg)
+	}
+	return proto.Unmarshal(body, msg)
+}
+
+// countMultipartParts counts the text fields and file parts (parts with a file name) of a multipart body
+func countMultipartParts(in *IncomingRequest) (fields int, files int, err error) {
+	mediaType, params, err := mime.ParseMediaType(in.R.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return 0, 0, fmt.Errorf("expected a multipart body but content type was %q", in.R.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(in.Body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fields, files, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not parse multipart body: %v", err)
+		}
+		if part.FileName() != "" {
+			files++
+		} else {
+			fields++
+		}
+	}
+}
+
+// ignoredHeaders are headers that are set by http clients and transports automatically and hop-by-hop headers
+// they are accepted by Strict and HeadersExactly without being expected explicitly (extended by Opts.IgnoredHeaders)
+var ignoredHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"User-Agent":        true,
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// jsonDiff compares the json values decoded by encoding/json key by key and returns one line per difference
+// naming its json path (e.g. "value at $.items[2].price: expected 10 but was 10.5", "missing field $.meta")
+// objects must not contain fields missing in expected unless partial is set, arrays have to contain the same elements in the same order
+func jsonDiff(path string, expected, actual interface{}, partial bool) []string {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		actualValue, ok := actual.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("value at %v: expected an object but was %v", path, stringify(actual))}
+		}
+
+		var diff []string
+		keys := make([]string, 0, len(expectedValue))
+		for key := range expectedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			actualField, ok := actualValue[key]
+			if !ok {
+				diff = append(diff, fmt.Sprintf("missing field %v.%v", path, key))
+				continue
+			}
+			diff = append(diff, jsonDiff(path+"."+key, expectedValue[key], actualField, partial)...)
+		}
+		if partial {
+			return diff
+		}
+
+		keys = keys[:0]
+		for key := range actualValue {
+			if _, ok := expectedValue[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diff = append(diff, fmt.Sprintf("unexpected field %v.%v", path, key))
+		}
+		return diff
+	case []interface{}:
+		actualValue, ok := actual.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("value at %v: expected an array but was %v", path, stringify(actual))}
+		}
+
+		var diff []string
+		n := len(expectedValue)
+		if len(actualValue) != n {
+			diff = append(diff, fmt.Sprintf("value at %v: expected %d elements but was %d", path, len(expectedValue), len(actualValue)))
+			if len(actualValue) < n {
+				n = len(actualValue)
+			}
+		}
+		for i := 0; i < n; i++ {
+			diff = append(diff, jsonDiff(fmt.Sprintf("%v[%d]", path, i), expectedValue[i], actualValue[i], partial)...)
+		}
+		return diff
+	default:
+		if !valuesEqual(actual, expected) {
+			return []string{fmt.Sprintf("value at %v: expected %v but was %v", path, stringify(expected), stringify(actual))}
+		}
+		return nil
+	}
+}
+
+// decodeJSONNumbers decodes the json document into value, numbers are decoded as json.Number
+func decodeJSONNumbers(data []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// jsonNumberKindDiff returns one line per number of actual that is a decimal number where expected has an integer
+// or vice versa (e.g. "value at $.price: expected an integer but was 10.0"), the values are compared by jsonDiff
+func jsonNumberKindDiff(path string, expected, actual interface{}) []string {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		actualValue, ok := actual.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		keys := make([]string, 0, len(expectedValue))
+		for key := range expectedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var diff []string
+		for _, key := range keys {
+			if actualField, ok := actualValue[key]; ok {
+				diff = append(diff, jsonNumberKindDiff(path+"."+key, expectedValue[key], actualField)...)
+			}
+		}
+		return diff
+	case []interface{}:
+		actualValue, ok := actual.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		var diff []string
+		for i := 0; i < len(expectedValue) && i < len(actualValue); i++ {
+			diff = append(diff, jsonNumberKindDiff(fmt.Sprintf("%v[%d]", path, i), expectedValue[i], actualValue[i])...)
+		}
+		return diff
+	case json.Number:
+		actualValue, ok := actual.(json.Number)
+		if !ok || isJSONInteger(expectedValue) == isJSONInteger(actualValue) {
+			return nil
+		}
+		if isJSONInteger(expectedValue) {
+			return []string{fmt.Sprintf("value at %v: expected an integer but was %v", path, actualValue)}
+		}
+		return []string{fmt.Sprintf("value at %v: expected a decimal number but was %v", path, actualValue)}
+	default:
+		return nil
+	}
+}
+
+// isJSONInteger checks if the json number is written as integer (without fraction or exponent)
+func isJSONInteger(number json.Number) bool {
+	return !strings.ContainsAny(number.String(), ".eE")
+}
+
+// requestReferer returns the Referer header of the request
+// the misspelled "Referrer" header is used as fallback
+func requestReferer(in *IncomingRequest) string {
+	if referer := in.R.Header.Get("Referer"); referer != "" {
+		return referer
+	}
+	return in.R.Header.Get("Referrer")
+}
+
+// normalizeXML returns one line per xml token, ignoring whitespace between elements, comments and attribute order
+func normalizeXML(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var lines []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			attrs := make([]string, 0, len(t.Attr))
+			for _, attr := range t.Attr {
+				attrs = append(attrs, fmt.Sprintf(" %v=%q", xmlName(attr.Name), attr.Value))
+			}
+			sort.Strings(attrs)
+			lines = append(lines, "<"+xmlName(t.Name)+strings.Join(attrs, "")+">")
+		case xml.EndElement:
+			lines = append(lines, "</"+xmlName(t.Name)+">")
+		case xml.CharData:
+			if text := strings.TrimSpace(string(t)); text != "" {
+				lines = append(lines, text)
+			}
+		}
+	}
+
+	if len(lines) == 0 {
+		return "", fmt.Errorf("no xml element found")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// requestRemoteIP returns the ip portion of the remote address of the request (without the port)
+func requestRemoteIP(in *IncomingRequest) string {
+	host, _, err := net.SplitHostPort(in.R.RemoteAddr)
+	if err != nil {
+		return in.R.RemoteAddr
+	}
+	return host
+}
+
+// requestForwardedFor returns all entries of the X-Forwarded-For chain (multiple headers are concatenated)
+func requestForwardedFor(in *IncomingRequest) []string {
+	var chain []string
+	for _, header := range in.R.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(header, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				chain = append(chain, entry)
+			}
+		}
+	}
+	return chain
+}
+
+// ipEqual compares two ip addresses, so that different notations of the same address are considered equal
+func ipEqual(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
+
+// jwtTokenClaims retrieves all claims from the bearer token of the request (the signature is not verified)
+func jwtTokenClaims(in *IncomingRequest) (jwt.MapClaims, error) {
+	if err := jwtTokenExistsValidation()(in); err != nil {
+		return nil, err
+	}
+
+	token := strings.TrimPrefix(in.R.Header.Get("Authorization"), "Bearer ")
+
+	parsedToken, _ := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return nil, nil
+	})
+
+	if parsedToken == nil {
+		return nil, fmt.Errorf("request validation failed: could not parse token")
+	}
+
+	claims, ok := parsedToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("request validation failed: could not retrieve claims from token")
+	}
+
+	return claims, nil
+}
+
+// jwtTokenClaimLookup retrieves the claim with the given json path from the bearer token of the request
+func jwtTokenClaimLookup(in *IncomingRequest, jsPath string) (interface{}, error) {
+	claims, err := jwtTokenClaims(in)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := jsonpath.JsonPathLookup(map[string]interface{}(claims), jsPath)
+	if err != nil {
+		return nil, fmt.Errorf("request validation failed: could not retrieve claim with path %s from token", jsPath)
+	}
+
+	return res, nil
+}
+
+// jwtTokenTimeClaim retrieves a registered temporal claim (e.g. exp, nbf, iat) from the bearer token of the request
+// a missing claim is reported as error instead of being treated as zero time
+func jwtTokenTimeClaim(in *IncomingRequest, name string) (time.Time, error) {
+	claims, err := jwtTokenClaims(in)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return timeClaim(claims, name)
+}
+
+// timeClaim converts the numeric date of the given claim to a time
+func timeClaim(claims jwt.MapClaims, name string) (time.Time, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, fmt.Errorf("request validation failed: token claim %v was missing", name)
+	}
+
+	seconds, ok := toFloat64(value)
+	if !ok {
+		return time.Time{}, fmt.Errorf("request validation failed: token claim %v is not a numeric date: %v", name, value)
+	}
+
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// valuesEqual compares two values using reflect.DeepEqual
+// numbers are compared by value, since decoded json numbers are always float64 (e.g. 123 equals float64(123))
+func valuesEqual(actual, expected interface{}) bool {
+	actualNumber, actualOk := toFloat64(actual)
+	expectedNumber, expectedOk := toFloat64(expected)
+	if actualOk && expectedOk {
+		return actualNumber == expectedNumber
+	}
+
+	if reflect.DeepEqual(actual, expected) {
+		return true
+	}
+
+	// compare nested maps and slices structurally, as if both values were decoded from json
+	return reflect.DeepEqual(normalizeJSON(actual), normalizeJSON(expected))
+}
+
+// normalizeJSON converts a go value to its decoded json representation (e.g. map[string]int becomes map[string]interface{} with float64 values)
+// the value is returned unchanged if it cannot be converted
+func normalizeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return value
+	}
+
+	return normalized
+}
+
+// toFloat64 converts any go number type to float64
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// stringify returns the string representation of a decoded json value
+// numbers are formatted without exponent (e.g. float64(1516239022) becomes "1516239022")
+func stringify(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// formParseError reports the error of parsing the form parameters of the request, it is only raised by form validations
+func formParseError(in *IncomingRequest) error {
+	return fmt.Errorf("request validation failed: could not parse form parameters: %v", in.formErr)
+}
+
+// mediaRange is a media range of an Accept header (e.g. "application/*;q=0.5")
+type mediaRange struct {
+	typ     string
+	subType string
+	q       float64
+}
+
+// matches checks if the media range matches the media type
+func (r mediaRange) matches(mediaType string) bool {
+	typ, subType, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mediaType)), "/")
+	return (r.typ == "*" || r.typ == typ) && (r.subType == "*" || r.subType == subType)
+}
+
+// specificity ranks type/subtype above type/* above */*
+func (r mediaRange) specificity() int {
+	switch {
+	case r.typ == "*":
+		return 0
+	case r.subType == "*":
+		return 1
+	}
+	return 2
+}
+
+// parseAccept parses the media ranges of the given Accept header values in order, the quality defaults to 1
+func parseAccept(accept []string) []mediaRange {
+	var ranges []mediaRange
+	for _, value := range accept {
+		for _, entry := range strings.Split(value, ",") {
+			params := strings.Split(entry, ";")
+			if strings.TrimSpace(params[0]) == "" {
+				continue
+			}
+
+			r := mediaRange{q: 1}
+			r.typ, r.subType, _ = strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+			for _, param := range params[1:] {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					if q, err := strconv.ParseFloat(val, 64); err == nil {
+						r.q = q
+					}
+				}
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// acceptsMediaType checks if one of the media ranges of the given Accept header values matches the media type
+// media ranges with a quality of 0 are not acceptable
+func acceptsMediaType(accept []string, mediaType string) bool {
+	for _, r := range parseAccept(accept) {
+		if r.q > 0 && r.matches(mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateMediaType selects the offered media type with the highest quality for the given Accept header values
+// the quality of an offer is taken from its most specific matching media range, ties are resolved by the order
+// of the media ranges and then alphabetically, a missing Accept header accepts any media type
+// an empty string is returned if no offer is acceptable
+func negotiateMediaType(accept []string, offers []string) string {
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		ranges = []mediaRange{{typ: "*", subType: "*", q: 1}}
+	}
+
+	sorted := append([]string{}, offers...)
+	sort.Strings(sorted)
+
+	best, bestQ, bestIndex := "", 0.0, len(ranges)
+	for _, offer := range sorted {
+		q, index, specificity := 0.0, len(ranges), -1
+		for i, r := range ranges {
+			if r.matches(offer) && r.specificity() > specificity {
+				q, index, specificity = r.q, i, r.specificity()
+			}
+		}
+		if q > bestQ || (q > 0 && q == bestQ && index < bestIndex) {
+			best, bestQ, bestIndex = offer, q, index
+		}
+	}
+	return best
+}
+
+// bodyDiffThreshold is the body length above which failure messages show a diff or a truncated body instead of the full body
+const bodyDiffThreshold = 256
+
+// bodyMismatch describes the difference between the expected and the actual body
+// short bodies are printed completely, longer bodies are reported by a compact line diff or by the first differing byte
+// verbose appends both bodies completely (see Opts.VerboseMismatch)
+func bodyMismatch(expected, actual []byte, verbose bool) string {
+	if len(expected) <= bodyDiffThreshold && len(actual) <= bodyDiffThreshold {
+		return fmt.Sprintf("body should be %v but was %v", string(expected), string(actual))
+	}
+
+	var msg string
+	if bytes.Contains(expected, []byte("\n")) || bytes.Contains(actual, []byte("\n")) {
+		msg = fmt.Sprintf("body did not match (- expected, + actual):\n%v", compactLineDiff(lineDiff(string(expected), string(actual)), 3))
+	} else {
+		i := 0
+		for i < len(expected) && i < len(actual) && expected[i] == actual[i] {
+			i++
+		}
+		msg = fmt.Sprintf("body did not match at byte %d (expected %d bytes, was %d bytes): expected %q but was %q",
+			i, len(expected), len(actual), excerpt(expected, i, 40), excerpt(actual, i, 40))
+	}
+
+	if verbose {
+		msg += fmt.Sprintf("\nexpected body:\n%v\nactual body:\n%v", string(expected), string(actual))
+	}
+	return msg
+}
+
+// bodyString returns the body of the request for failure messages, it is truncated unless Opts.VerboseMismatch is set
+func bodyString(in *IncomingRequest) string {
+	if in.verbose || len(in.Body) <= bodyDiffThreshold {
+		return string(in.Body)
+	}
+	return fmt.Sprintf("%v... (%d bytes, set Opts.VerboseMismatch to show the full body)", string(in.Body[:bodyDiffThreshold]), len(in.Body))
+}
+
+// excerpt returns up to n bytes of data around the given offset, omitted bytes are marked with ...
+func excerpt(data []byte, offset, n int) string {
+	start, end := offset-n/2, offset+n/2
+	if start < 0 {
+		start = 0
+	}
+	if end > len(data) {
+		end = len(data)
+	}
+
+	part := string(data[start:end])
+	if start > 0 {
+		part = "..." + part
+	}
+	if end < len(data) {
+		part += "..."
+	}
+	return part
+}
+
+// compactLineDiff removes unchanged lines of a diff created by lineDiff that are further than context lines away from a change
+func compactLineDiff(diff string, context int) string {
+	lines := strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if strings.HasPrefix(line, "  ") {
+			continue
+		}
+		for j := i - context; j <= i+context; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var buf strings.Builder
+	skipped := 0
+	for i, line := range lines {
+		if !keep[i] {
+			skipped++
+			continue
+		}
+		if skipped > 0 {
+			buf.WriteString(fmt.Sprintf("  ... (%d unchanged lines)\n", skipped))
+			skipped = 0
+		}
+		buf.WriteString(line + "\n")
+	}
+	if skipped > 0 {
+		buf.WriteString(fmt.Sprintf("  ... (%d unchanged lines)\n", skipped))
+	}
+	return buf.String()
+}
+
+// lineDiff returns a line based diff of two strings
+// lines only in expected are prefixed with "- ", lines only in actual with "+ " and common lines with "  "
+func lineDiff(expected, actual string) string {
+	a := strings.Split(strings.TrimSuffix(expected, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(actual, "\n"), "\n")
+
+	// longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var buf strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			buf.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			buf.WriteString("+ " + b[j] + "\n")
+			j++
+		default:
+			buf.WriteString("- " + a[i] + "\n")
+			i++
+		}
+	}
+
+	return buf.String()
+}
+
+// tlsVersionName returns the name of the TLS version (e.g. "TLS 1.2"), unknown versions are printed as hex value
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionSSL30:
+		return "SSL 3.0"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}